@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+	"strunetsdrive/internal/config"
+	"strunetsdrive/internal/repository"
+	"strunetsdrive/internal/service"
+)
+
+// runCommand executes a maintenance command instead of starting the server.
+func runCommand(ctx context.Context, cfg *config.Config, name string, args []string) error {
+	switch name {
+	case "rotate-keys":
+		return rotateKeys(ctx, cfg, args)
+	case "reconcile":
+		return reconcile(ctx, cfg, args)
+	case "migrate":
+		return migrate(ctx, cfg, args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// rotateKeys re-wraps every object data key with the configured key_id. The
+// previous master keys must still be listed under storage.encryption.keys.
+func rotateKeys(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only rotate data keys of objects under this key prefix")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	baseStore, err := newBaseStore(cfg.Storage)
+	if err != nil {
+		return err
+	}
+
+	// The server encrypts on top of tiering, so data keys of cold objects
+	// live in the cold store and are only reached through the tiered one.
+	if cfg.Storage.Tiering.Enabled {
+		baseStore, err = newTieredStore(baseStore, cfg.Storage.Tiering)
+		if err != nil {
+			return err
+		}
+	}
+
+	store, err := newEncryptedStore(baseStore, cfg.Storage.Encryption)
+	if err != nil {
+		return err
+	}
+
+	rotated, err := store.RotateKeys(ctx, *prefix)
+	if err != nil {
+		return fmt.Errorf("key rotation stopped after %d objects: %w", rotated, err)
+	}
+
+	log.Printf("Re-wrapped %d data keys with master key %q", rotated, cfg.Storage.Encryption.KeyID)
+	return nil
+}
+
+// reconcile compares stored objects with the files table once. Without
+// -repair it only reports what it found.
+func reconcile(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "delete orphan objects and rows whose object is missing")
+	grace := flags.Duration("grace", cfg.Storage.Reconcile.GracePeriod, "ignore objects modified more recently than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	fileStore, err := newFileStore(cfg.Storage)
+	if err != nil {
+		return err
+	}
+
+	reconciler := service.NewReconciler(repository.NewStoreRepo(db), fileStore, *grace)
+	report, err := reconciler.Reconcile(ctx, *repair)
+	if err != nil {
+		return err
+	}
+	report.Log()
+
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("failed to repair %d items", len(report.Failed))
+	}
+	return nil
+}
+
+// migrate copies all referenced objects from the configured storage backend to
+// migration.target. It can be interrupted and re-run; -finalize additionally
+// rewrites files.path once everything has been copied. Afterwards storage has
+// to be switched to the target configuration. A target on the same MinIO
+// bucket with another layout or key prefix moves the existing keys there;
+// -cleanup then removes them from the old place. Blobs are stored under the
+// key prefix alone, so only a new prefix moves them.
+func migrate(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	finalize := flags.Bool("finalize", false, "rewrite file paths after the copy pass; stop uploads first")
+	cleanup := flags.Bool("cleanup", false, "with -finalize, delete the migrated source objects; stop the server first")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *cleanup {
+		if !*finalize {
+			return fmt.Errorf("-cleanup requires -finalize")
+		}
+		if cfg.Migration.KeyPrefix == "" && sameKeys(cfg.Storage, cfg.Migration.Target) {
+			return fmt.Errorf("-cleanup would delete the migrated objects: target stores them where the configured storage does")
+		}
+	}
+
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	source, err := newFileStore(cfg.Storage)
+	if err != nil {
+		return err
+	}
+
+	target, err := newFileStore(cfg.Migration.Target)
+	if err != nil {
+		return fmt.Errorf("migration target: %w", err)
+	}
+
+	var rewrite func(string) string
+	if prefix := cfg.Migration.KeyPrefix; prefix != "" {
+		rewrite = func(path string) string { return prefix + path }
+	}
+
+	migrator := service.NewMigrator(repository.NewStoreRepo(db), source, target, rewrite)
+	if *finalize {
+		report, rewritten, err := migrator.Finalize(ctx)
+		if report != nil {
+			log.Printf("Copied %d objects, %d already migrated", report.Copied, report.Skipped)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Rewrote %d file paths", rewritten)
+
+		if *cleanup {
+			deleted, err := migrator.Cleanup(ctx, report.Sources)
+			log.Printf("Deleted %d of %d source objects", deleted, len(report.Sources))
+			if err != nil {
+				// The paths are rewritten already, so the objects left over
+				// are listed in the warnings above and have to go by hand.
+				return fmt.Errorf("cleanup incomplete: %w", err)
+			}
+		}
+
+		log.Print("Switch storage to the migration target now")
+		return nil
+	}
+
+	report, err := migrator.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Copied %d objects, %d already migrated, %d failed", report.Copied, report.Skipped, len(report.Failed))
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("failed to copy %d objects; run migrate again to retry", len(report.Failed))
+	}
+	return nil
+}
+
+// sameKeys reports whether two storage configurations store a key at the
+// same place. MinIO layouts differ only for per-user keys, so two of them on
+// one bucket and prefix share every blob.
+func sameKeys(a, b config.StorageConfig) bool {
+	if a.Type == "minio" && b.Type == "minio" {
+		return a.Minio.Endpoint == b.Minio.Endpoint &&
+			a.Minio.Bucket == b.Minio.Bucket &&
+			a.Minio.KeyPrefix == b.Minio.KeyPrefix
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -1,54 +1,79 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	cors2 "github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strunetsdrive/internal/config"
 	"strunetsdrive/internal/repository"
 	"strunetsdrive/internal/service"
 	"strunetsdrive/internal/transport/rest"
 	"strunetsdrive/pkg/database"
-	"strunetsdrive/pkg/filestore"
-	"strunetsdrive/pkg/filestore/minio"
+	"strunetsdrive/pkg/filestore/faulty"
+	"strunetsdrive/pkg/filestore/replicated"
+	"syscall"
 	"time"
 )
 
+// shutdownTimeout bounds how long a shutdown waits for cancelled requests to
+// clean up after themselves.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	db, err := database.NewPostgresConnection(database.ConnectionInfo{
-		Host:     "localhost",
-		Port:     5432,
-		Username: "postgres",
-		DBName:   "postgres",
-		SSLMode:  "disable",
-		Password: "qwerty",
-	})
+	// Cancelled on SIGINT or SIGTERM, which stops background tasks and every
+	// in-flight request.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, cfg, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	db, err := connectDatabase()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	var fileStore filestore.Store
-	if cfg.Storage.Type == "minio" {
-		fileStore, err = minio.NewStore(
-			cfg.Storage.Minio.Endpoint,
-			cfg.Storage.Minio.AccessKey,
-			cfg.Storage.Minio.SecretKey,
-			cfg.Storage.Minio.Bucket,
-			cfg.Storage.Minio.UseSSL,
-		)
+	baseStore, err := newBaseStore(cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	innerStore := baseStore
+	var faults *faulty.Store
+	if cfg.Storage.Faults.Enabled {
+		faults, err = newFaultyStore(baseStore, cfg.Storage.Faults)
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Printf("Using MinIO storage at %s", cfg.Storage.Minio.Endpoint)
+		innerStore = faults
+	}
+
+	fileStore, err := decorateStore(innerStore, cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if mirror, ok := baseStore.(*replicated.Store); ok && cfg.Storage.Replication.RepairInterval > 0 {
+		go mirror.RunRepair(ctx, cfg.Storage.Replication.RepairInterval, cfg.Storage.Replication.RepairGracePeriod)
 	}
 
 	//init repo
@@ -58,7 +83,25 @@ func main() {
 
 	//init service
 	usersService := service.NewUsers(usersRepository, tokensRepository, time.Hour*24, "testgovna")
-	storeService := service.NewStoreService(storeRepository, fileStore)
+	storeService := service.NewStoreService(storeRepository, fileStore, service.ChecksumOptions{
+		MD5:    cfg.Storage.Checksum.MD5,
+		Verify: cfg.Storage.Checksum.Verify,
+	}, service.UploadOptions{
+		BaseURL: cfg.Uploads.BaseURL,
+		Secret:  []byte(cfg.Uploads.Secret),
+		Expiry:  cfg.Uploads.Expiry,
+		MaxSize: cfg.Uploads.MaxSize,
+	})
+
+	if interval := cfg.Storage.Reconcile.Interval; interval > 0 {
+		reconciler := service.NewReconciler(storeRepository, fileStore, cfg.Storage.Reconcile.GracePeriod)
+		go reconciler.Run(ctx, interval, cfg.Storage.Reconcile.Repair)
+	}
+
+	if cfg.Storage.Tiering.Enabled && cfg.Storage.Tiering.Interval > 0 {
+		tiering := service.NewTiering(storeRepository, fileStore, cfg.Storage.Tiering.IdleAfter)
+		go tiering.Run(ctx, cfg.Storage.Tiering.Interval)
+	}
 
 	//init handlers
 	userHandler := rest.NewAuthHandler(usersService)
@@ -80,26 +123,50 @@ func main() {
 	// Setup routes
 	userHandler.InjectRoutes(router)
 	fileHandler.InjectRoutes(router, userHandler.AuthMiddleware())
+	if faults != nil {
+		if token := cfg.Storage.Faults.AdminToken; token != "" {
+			rest.NewFaultHandler(faults).InjectRoutes(router, rest.AdminTokenMiddleware(token))
+		} else {
+			log.Print("Fault injection has no admin_token, /admin/faults is disabled")
+		}
+	}
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", 8080),
 		Handler: router,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
 	}
 	log.Print("starting server on port 8080")
 
-	log.Printf("Starting server on %s", 8080)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("Could not listen on %s: %v", cfg.ServerAddress, err)
+	go func() {
+		log.Printf("Starting server on %d", 8080)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Could not listen on %s: %v", cfg.ServerAddress, err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Print("shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown failed: %v", err)
 	}
 }
 
-//} else {
-//	fileStore, err = local.NewStore(cfg.Storage.Local.Path)
-//	if err != nil {
-//		log.Fatal(err)
-//	}
-//	log.Printf("Using local storage at %s", cfg.Storage.Local.Path)
-//}
+func connectDatabase() (*sqlx.DB, error) {
+	return database.NewPostgresConnection(database.ConnectionInfo{
+		Host:     "localhost",
+		Port:     5432,
+		Username: "postgres",
+		DBName:   "postgres",
+		SSLMode:  "disable",
+		Password: "qwerty",
+	})
+}
 
 //path := "C:\\localhost\\"
 //log.Printf("repo path: %s", path)
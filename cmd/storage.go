@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strunetsdrive/internal/config"
+	"strunetsdrive/internal/service"
+	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/compressed"
+	"strunetsdrive/pkg/filestore/encrypted"
+	"strunetsdrive/pkg/filestore/faulty"
+	"strunetsdrive/pkg/filestore/local"
+	"strunetsdrive/pkg/filestore/memory"
+	"strunetsdrive/pkg/filestore/minio"
+	"strunetsdrive/pkg/filestore/replicated"
+	"strunetsdrive/pkg/filestore/resilient"
+	"strunetsdrive/pkg/filestore/tiered"
+)
+
+// newFileStore builds the configured backend together with every enabled
+// decorator.
+func newFileStore(cfg config.StorageConfig) (filestore.Store, error) {
+	baseStore, err := newBaseStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return decorateStore(baseStore, cfg)
+}
+
+// decorateStore wraps a backend in the decorators enabled in cfg.
+func decorateStore(fileStore filestore.Store, cfg config.StorageConfig) (filestore.Store, error) {
+	var err error
+	if cfg.Tiering.Enabled {
+		fileStore, err = newTieredStore(fileStore, cfg.Tiering)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Encryption.Enabled {
+		fileStore, err = newEncryptedStore(fileStore, cfg.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Encrypting objects with master key %q", cfg.Encryption.KeyID)
+	}
+
+	// The compressed store wraps the encrypted one, so content is compressed
+	// before it is encrypted; ciphertext does not compress.
+	if cfg.Compression.Enabled {
+		fileStore, err = compressed.NewStore(fileStore, cfg.Compression.Level)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Compressing objects with zstd level %d", cfg.Compression.Level)
+	}
+
+	return fileStore, nil
+}
+
+func newBaseStore(cfg config.StorageConfig) (filestore.Store, error) {
+	var fileStore filestore.Store
+	switch cfg.Type {
+	case "minio":
+		minioStore, err := minio.NewStore(
+			cfg.Minio.Endpoint,
+			cfg.Minio.AccessKey,
+			cfg.Minio.SecretKey,
+			cfg.Minio.Bucket,
+			cfg.Minio.UseSSL,
+			minio.Layout{
+				Prefix: cfg.Minio.KeyPrefix,
+				Scheme: cfg.Minio.Layout,
+				Shared: []string{service.BlobDir},
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Using MinIO storage at %s with %q key layout", cfg.Minio.Endpoint, cfg.Minio.Layout)
+		fileStore = minioStore
+	case "local":
+		localStore, err := local.NewStore(cfg.Local.Path)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Using local storage at %s", cfg.Local.Path)
+		fileStore = localStore
+	case "memory":
+		// Nothing survives a restart; meant for previews and tests.
+		log.Print("Using in-memory storage, objects are lost on restart")
+		fileStore = memory.NewStore()
+	case "replicated":
+		return newReplicatedStore(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	}
+
+	// Resilience wraps each backend individually, so that a replica or tier
+	// that is down fails fast without affecting the others.
+	if cfg.Resilience.Enabled {
+		fileStore = resilient.NewStore(fileStore, cfg.Type, resilient.Options{
+			Timeouts:         cfg.Resilience.Timeouts,
+			MaxRetries:       cfg.Resilience.MaxRetries,
+			BaseDelay:        cfg.Resilience.BaseDelay,
+			MaxDelay:         cfg.Resilience.MaxDelay,
+			FailureThreshold: cfg.Resilience.FailureThreshold,
+			Cooldown:         cfg.Resilience.Cooldown,
+		})
+	}
+
+	return fileStore, nil
+}
+
+// newReplicatedStore mirrors onto the backends listed under replicas. Only
+// their backend settings are used; decorators apply to the mirrored store as
+// a whole.
+func newReplicatedStore(cfg config.StorageConfig) (*replicated.Store, error) {
+	replicas := make([]filestore.Store, 0, len(cfg.Replicas))
+	for i, replicaCfg := range cfg.Replicas {
+		replica, err := newBaseStore(replicaCfg)
+		if err != nil {
+			return nil, fmt.Errorf("replica %d: %w", i, err)
+		}
+		replicas = append(replicas, replica)
+	}
+
+	fileStore, err := replicated.NewStore(replicas, cfg.Replication.WriteQuorum)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Replicating objects to %d stores", len(replicas))
+	return fileStore, nil
+}
+
+func newTieredStore(hot filestore.Store, cfg config.TieringConfig) (*tiered.Store, error) {
+	if cfg.Cold == nil {
+		return nil, fmt.Errorf("tiering is enabled but no cold storage is configured")
+	}
+	if cfg.IdleAfter <= 0 {
+		return nil, fmt.Errorf("tiering idle_after must be positive, got %s", cfg.IdleAfter)
+	}
+
+	cold, err := newBaseStore(*cfg.Cold)
+	if err != nil {
+		return nil, fmt.Errorf("cold tier: %w", err)
+	}
+
+	log.Printf("Moving files idle for %s to %s storage", cfg.IdleAfter, cfg.Cold.Type)
+	return tiered.NewStore(hot, cold), nil
+}
+
+func newEncryptedStore(inner filestore.Store, cfg config.EncryptionConfig) (*encrypted.Store, error) {
+	keys, err := encrypted.ParseKeys(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypted.NewStore(inner, keys, cfg.KeyID, cfg.AllowPlaintext)
+}
+
+// newFaultyStore wraps the backend, below every decorator, in the fault
+// injector configured in cfg.
+func newFaultyStore(inner filestore.Store, cfg config.FaultsConfig) (*faulty.Store, error) {
+	rules := make([]faulty.Rule, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		rules = append(rules, faulty.Rule{
+			Op:            rule.Op,
+			Pattern:       rule.Pattern,
+			Rate:          rule.Rate,
+			Latency:       rule.Latency,
+			Error:         rule.Error,
+			TruncateAfter: rule.TruncateAfter,
+			FailClose:     rule.FailClose,
+			Limit:         rule.Limit,
+		})
+	}
+
+	fileStore, err := faulty.NewStore(inner, rules)
+	if err != nil {
+		return nil, fmt.Errorf("storage faults: %w", err)
+	}
+	log.Printf("Injecting storage faults with %d rules", len(rules))
+	return fileStore, nil
+}
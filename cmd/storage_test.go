@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strunetsdrive/internal/config"
+	"strunetsdrive/pkg/filestore/memory"
+	"testing"
+)
+
+func TestDecorateStoreCompressesBeforeEncrypting(t *testing.T) {
+	ctx := context.Background()
+	base := memory.NewStore()
+
+	cfg := config.StorageConfig{
+		Compression: config.CompressionConfig{Enabled: true, Level: 3},
+		Encryption: config.EncryptionConfig{
+			Enabled: true,
+			KeyID:   "k1",
+			Keys:    map[string]string{"k1": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))},
+		},
+	}
+	store, err := decorateStore(base, cfg)
+	if err != nil {
+		t.Fatalf("decorateStore: %v", err)
+	}
+
+	var csv bytes.Buffer
+	for i := 0; csv.Len() < 1500000; i++ {
+		fmt.Fprintf(&csv, "%d,customer-%d,2024-01-%02d,%d.%02d\n", i, i%1000, i%28+1, i%500, i%100)
+	}
+
+	w, err := store.Create(ctx, "user/report.csv")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write(csv.Bytes()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	info, err := base.GetObjectInfo(ctx, "user/report.csv")
+	if err != nil {
+		t.Fatalf("GetObjectInfo: %v", err)
+	}
+	if info.Size >= int64(csv.Len())/2 {
+		t.Fatalf("stored %d bytes for %d bytes of CSV, content was not compressed", info.Size, csv.Len())
+	}
+
+	r, err := store.Open(ctx, "user/report.csv")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, csv.Bytes()) {
+		t.Fatal("read content differs from the written content")
+	}
+}
@@ -1,33 +1,168 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"github.com/spf13/viper"
+	"time"
+)
 
 type Config struct {
-	ServerAddress string        `json:"server_address"`
-	DatabaseURL   string        `json:"database_url"`
-	StoragePath   string        `json:"storage_path"`
-	JWTSecret     string        `json:"jwt_secret"`
-	Storage       StorageConfig `mapstructure:"storage"`
+	ServerAddress string          `json:"server_address"`
+	DatabaseURL   string          `json:"database_url"`
+	StoragePath   string          `json:"storage_path"`
+	JWTSecret     string          `json:"jwt_secret"`
+	Storage       StorageConfig   `mapstructure:"storage"`
+	Migration     MigrationConfig `mapstructure:"migration"`
+	Uploads       UploadsConfig   `mapstructure:"uploads"`
 }
 
 type StorageConfig struct {
-	Type  string      `mapstructure:"type"`
-	Minio MinioConfig `mapstructure:"minio"`
-	Local LocalConfig `mapstructure:"local"`
+	Type        string            `mapstructure:"type"`
+	Minio       MinioConfig       `mapstructure:"minio"`
+	Local       LocalConfig       `mapstructure:"local"`
+	Encryption  EncryptionConfig  `mapstructure:"encryption"`
+	Compression CompressionConfig `mapstructure:"compression"`
+	Checksum    ChecksumConfig    `mapstructure:"checksum"`
+	Resilience  ResilienceConfig  `mapstructure:"resilience"`
+	Reconcile   ReconcileConfig   `mapstructure:"reconcile"`
+	// Replicas lists the backends mirrored to when Type is "replicated".
+	Replicas    []StorageConfig   `mapstructure:"replicas"`
+	Replication ReplicationConfig `mapstructure:"replication"`
+	Tiering     TieringConfig     `mapstructure:"tiering"`
+	Faults      FaultsConfig      `mapstructure:"faults"`
 }
 
+// MinioConfig connects to a MinIO bucket. Layout ("flat", "tenant-buckets"
+// or "hashed") and KeyPrefix decide where keys are stored. The layout only
+// places the per-user keys; the deduplicated blobs stay in the bucket under
+// KeyPrefix in every layout, so deployments sharing a cluster need a prefix
+// or a bucket each. To change layout or prefix on a bucket in use, configure
+// the new one as migration.target and run migrate. Until storage is switched
+// over, the old layout sees the copies in a shared bucket as unreferenced
+// objects, so reconcile repair must stay off.
 type MinioConfig struct {
 	Endpoint  string `mapstructure:"endpoint"`
 	AccessKey string `mapstructure:"access_key"`
 	SecretKey string `mapstructure:"secret_key"`
 	Bucket    string `mapstructure:"bucket"`
 	UseSSL    bool   `mapstructure:"use_ssl"`
+	Layout    string `mapstructure:"layout"`
+	KeyPrefix string `mapstructure:"key_prefix"`
 }
 
 type LocalConfig struct {
 	Path string `mapstructure:"path"`
 }
 
+// EncryptionConfig holds base64 encoded 32 byte master keys by ID. KeyID
+// selects the key new objects are wrapped with; older keys stay listed until
+// rotate-keys has re-wrapped everything. AllowPlaintext keeps objects stored
+// before encryption was enabled readable; without it, reading an object that
+// has no data key fails.
+type EncryptionConfig struct {
+	Enabled        bool              `mapstructure:"enabled"`
+	KeyID          string            `mapstructure:"key_id"`
+	Keys           map[string]string `mapstructure:"keys"`
+	AllowPlaintext bool              `mapstructure:"allow_plaintext"`
+}
+
+// CompressionConfig enables zstd compression of stored objects at Level
+// (1-22). Already compressed content is stored as is.
+type CompressionConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	Level   int  `mapstructure:"level"`
+}
+
+// ChecksumConfig enables an extra MD5 digest on upload and selects how
+// downloads are verified: "off", "log" or "abort".
+type ChecksumConfig struct {
+	MD5    bool   `mapstructure:"md5"`
+	Verify string `mapstructure:"verify"`
+}
+
+// ResilienceConfig bounds backend calls by operation name ("open", "list",
+// ... or "default"), retries idempotent ones and opens a circuit breaker
+// after FailureThreshold consecutive failures.
+type ResilienceConfig struct {
+	Enabled          bool                     `mapstructure:"enabled"`
+	Timeouts         map[string]time.Duration `mapstructure:"timeouts"`
+	MaxRetries       int                      `mapstructure:"max_retries"`
+	BaseDelay        time.Duration            `mapstructure:"base_delay"`
+	MaxDelay         time.Duration            `mapstructure:"max_delay"`
+	FailureThreshold int                      `mapstructure:"failure_threshold"`
+	Cooldown         time.Duration            `mapstructure:"cooldown"`
+}
+
+// ReconcileConfig schedules the background orphan check. A zero Interval
+// disables it; without Repair findings are only logged. Objects younger than
+// GracePeriod are never treated as orphans.
+type ReconcileConfig struct {
+	Interval    time.Duration `mapstructure:"interval"`
+	Repair      bool          `mapstructure:"repair"`
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+}
+
+// ReplicationConfig sets how many replicas a write must reach (0 for all) and
+// how often missing copies are restored. A zero RepairInterval disables the
+// background repair.
+type ReplicationConfig struct {
+	WriteQuorum       int           `mapstructure:"write_quorum"`
+	RepairInterval    time.Duration `mapstructure:"repair_interval"`
+	RepairGracePeriod time.Duration `mapstructure:"repair_grace_period"`
+}
+
+// TieringConfig moves files nobody downloaded for IdleAfter to the Cold
+// backend, checking every Interval.
+type TieringConfig struct {
+	Enabled   bool           `mapstructure:"enabled"`
+	Cold      *StorageConfig `mapstructure:"cold"`
+	IdleAfter time.Duration  `mapstructure:"idle_after"`
+	Interval  time.Duration  `mapstructure:"interval"`
+}
+
+// FaultsConfig injects storage failures to test how the API copes with
+// them. The rules can be replaced at runtime through /admin/faults, which is
+// only served while Enabled and AdminToken is set, to requests carrying
+// AdminToken as their bearer token. Never enable it in production.
+type FaultsConfig struct {
+	Enabled    bool        `mapstructure:"enabled"`
+	AdminToken string      `mapstructure:"admin_token"`
+	Rules      []FaultRule `mapstructure:"rules"`
+}
+
+// FaultRule mirrors faulty.Rule: calls of Op ("open", "create", ... or "*")
+// on keys matching Pattern are delayed by Latency and, at Rate, failed,
+// truncated after TruncateAfter bytes or have their Close fail.
+type FaultRule struct {
+	Op            string        `mapstructure:"op"`
+	Pattern       string        `mapstructure:"pattern"`
+	Rate          float64       `mapstructure:"rate"`
+	Latency       time.Duration `mapstructure:"latency"`
+	Error         bool          `mapstructure:"error"`
+	TruncateAfter *int64        `mapstructure:"truncate_after"`
+	FailClose     bool          `mapstructure:"fail_close"`
+	Limit         int           `mapstructure:"limit"`
+}
+
+// MigrationConfig describes the backend the migrate command copies objects
+// to. KeyPrefix is prepended to every key in the target, e.g. to move all
+// objects under a common prefix in a shared bucket.
+type MigrationConfig struct {
+	Target    StorageConfig `mapstructure:"target"`
+	KeyPrefix string        `mapstructure:"key_prefix"`
+}
+
+// UploadsConfig controls direct upload sessions. Backends that cannot presign
+// uploads get URLs to the API itself, at BaseURL, signed with Secret. Expiry
+// should not exceed storage.reconcile.grace_period, or the reconciler may
+// take an uploaded object that is not finalized yet for an orphan. A zero
+// MaxSize allows any size.
+type UploadsConfig struct {
+	BaseURL string        `mapstructure:"base_url"`
+	Secret  string        `mapstructure:"secret"`
+	Expiry  time.Duration `mapstructure:"expiry"`
+	MaxSize int64         `mapstructure:"max_size"`
+}
+
 func Load() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -12,16 +12,65 @@ import "time"
 //}
 
 type File struct {
-	ID         string    `db:"id"`
-	Name       string    `db:"name"`
+	ID          string    `db:"id"`
+	Name        string    `db:"name"`
+	Path        string    `db:"path"`
+	Size        int64     `db:"size"`
+	Username    string    `db:"username"`
+	UploadedAt  time.Time `db:"uploaded_at"`
+	IsDir       bool      `db:"is_dir"`
+	FolderID    string    `db:"folder_id"`
+	BlobHash    string    `db:"blob_hash"`
+	Checksum    string    `db:"checksum"`
+	ChecksumMD5 string    `db:"checksum_md5"`
+	Tier        string    `db:"tier"`
+}
+
+// FileResult is the outcome of one item of a batch operation on files.
+type FileResult struct {
+	FileID string
+	File   *File
+	Err    error
+}
+
+// Blob is a content-addressed object shared by every file with the same
+// SHA-256. RefCount is kept in sync with the files table by a trigger.
+type Blob struct {
+	Hash      string    `db:"hash"`
+	Path      string    `db:"path"`
+	Size      int64     `db:"size"`
+	RefCount  int       `db:"ref_count"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// MigratedObject records an object copied to another storage backend, so an
+// interrupted migration can resume where it stopped.
+type MigratedObject struct {
 	Path       string    `db:"path"`
+	NewPath    string    `db:"new_path"`
 	Size       int64     `db:"size"`
-	Username   string    `db:"username"`
-	UploadedAt time.Time `db:"uploaded_at"`
-	IsDir      bool      `db:"is_dir"`
-	FolderID   string    `db:"folder_id"`
+	Checksum   string    `db:"checksum"`
+	MigratedAt time.Time `db:"migrated_at"`
 }
 
+// UploadSession is a pending direct upload. The client stores the object at
+// Path itself, through UploadURL, and finalizes the session to create the
+// file.
+type UploadSession struct {
+	ID        string    `db:"id"`
+	Username  string    `db:"username"`
+	FolderID  string    `db:"folder_id"`
+	Name      string    `db:"name"`
+	Path      string    `db:"path"`
+	Size      int64     `db:"size"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+	UploadURL string    `db:"-"`
+}
+
+// Folder is a node of a user's tree. Size and FileCount cover the whole
+// subtree and are maintained by a trigger on files and by folder moves, so
+// the Root folder holds the user's totals.
 type Folder struct {
 	ID        string    `db:"id"`
 	Name      string    `db:"name"`
@@ -29,6 +78,23 @@ type Folder struct {
 	Username  string    `db:"username"`
 	CreatedAt time.Time `db:"created_at"`
 	PathArray []string  `db:"path_array"`
+	Size      int64     `db:"size"`
+	FileCount int64     `db:"file_count"`
 	Files     []*File   `db:"-"`
 	Folders   []*Folder `db:"-"`
 }
+
+// CopyJob tracks the copy of a folder tree. FolderID is the new top folder.
+type CopyJob struct {
+	ID         string
+	Username   string
+	SourceID   string
+	FolderID   string
+	Status     string
+	Total      int
+	Copied     int
+	Failed     []*FileResult
+	Error      string
+	CreatedAt  time.Time
+	FinishedAt *time.Time
+}
@@ -1,6 +1,9 @@
 package repository
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -17,27 +20,27 @@ func NewStoreRepo(db *sqlx.DB) *StoreRepo {
 	return &StoreRepo{db}
 }
 
-func (r *StoreRepo) GetRootFolder(username string) (*models.Folder, error) {
+func (r *StoreRepo) GetRootFolder(ctx context.Context, username string) (*models.Folder, error) {
 	query := `
-        SELECT id, name, username 
+        SELECT id, name, username, size, file_count
         FROM folders 
         WHERE username = $1 AND name = 'Root' AND parent_id IS NULL
     `
 	var folder models.Folder
-	err := r.db.QueryRow(query, username).Scan(&folder.ID, &folder.Name, &folder.Username)
+	err := r.db.QueryRowContext(ctx, query, username).Scan(&folder.ID, &folder.Name, &folder.Username, &folder.Size, &folder.FileCount)
 	if err != nil {
 		return nil, fmt.Errorf("could not find root folder for user %s: %w", username, err)
 	}
 	return &folder, nil
 }
 
-func (r *StoreRepo) GetFolderContent(folderID string) (*models.Folder, error) {
+func (r *StoreRepo) GetFolderContent(ctx context.Context, folderID string) (*models.Folder, error) {
 	folder := &models.Folder{}
 
 	var parentID *string
 
-	err := r.db.QueryRow(`
-    SELECT id, name, parent_id, username, created_at
+	err := r.db.QueryRowContext(ctx, `
+    SELECT id, name, parent_id, username, created_at, size, file_count
     FROM folders 
     WHERE id = $1
     `, folderID).Scan(
@@ -46,6 +49,8 @@ func (r *StoreRepo) GetFolderContent(folderID string) (*models.Folder, error) {
 		&parentID,
 		&folder.Username,
 		&folder.CreatedAt,
+		&folder.Size,
+		&folder.FileCount,
 	)
 	if err != nil {
 		return nil, err
@@ -55,8 +60,8 @@ func (r *StoreRepo) GetFolderContent(folderID string) (*models.Folder, error) {
 		folder.ParentID = *parentID
 	}
 
-	rows, err := r.db.Query(`
-    SELECT id, name, parent_id, username, created_at
+	rows, err := r.db.QueryContext(ctx, `
+    SELECT id, name, parent_id, username, created_at, size, file_count
     FROM folders 
     WHERE parent_id = $1
     `, folderID)
@@ -73,6 +78,8 @@ func (r *StoreRepo) GetFolderContent(folderID string) (*models.Folder, error) {
 			&subfolder.ParentID,
 			&subfolder.Username,
 			&subfolder.CreatedAt,
+			&subfolder.Size,
+			&subfolder.FileCount,
 		)
 		if err != nil {
 			return nil, err
@@ -80,7 +87,7 @@ func (r *StoreRepo) GetFolderContent(folderID string) (*models.Folder, error) {
 		folder.Folders = append(folder.Folders, subfolder)
 	}
 
-	fileRows, err := r.db.Query(`
+	fileRows, err := r.db.QueryContext(ctx, `
     SELECT id, name, path, size, username, uploaded_at, is_dir
     FROM files 
     WHERE folder_id = $1 AND is_dir = false
@@ -110,12 +117,14 @@ func (r *StoreRepo) GetFolderContent(folderID string) (*models.Folder, error) {
 	return folder, nil
 }
 
-func (r *StoreRepo) GetFile(id string) (*models.File, error) {
+func (r *StoreRepo) GetFile(ctx context.Context, id string) (*models.File, error) {
 	var file models.File
-	err := r.db.QueryRow(`
-	SELECT id, name, path, size, username,uploaded_at
+	err := r.db.QueryRowContext(ctx, `
+	SELECT id, name, path, size, username, uploaded_at, folder_id, COALESCE(blob_hash, ''),
+	       COALESCE(checksum, ''), COALESCE(checksum_md5, ''), tier
 	FROM files WHERE id = $1
-`, id).Scan(&file.ID, &file.Name, &file.Path, &file.Size, &file.Username, &file.UploadedAt)
+`, id).Scan(&file.ID, &file.Name, &file.Path, &file.Size, &file.Username, &file.UploadedAt, &file.FolderID, &file.BlobHash,
+		&file.Checksum, &file.ChecksumMD5, &file.Tier)
 	if err != nil {
 		return nil, err
 	}
@@ -123,8 +132,8 @@ func (r *StoreRepo) GetFile(id string) (*models.File, error) {
 	return &file, nil
 }
 
-func (r *StoreRepo) GetFileByUser(username string) ([]*models.File, error) {
-	rows, err := r.db.Query(`
+func (r *StoreRepo) GetFileByUser(ctx context.Context, username string) ([]*models.File, error) {
+	rows, err := r.db.QueryContext(ctx, `
     SELECT id, name, path, size, uploaded_at, is_dir, folder_id
     FROM files 
     WHERE username = $1 AND is_dir = false
@@ -154,9 +163,9 @@ func (r *StoreRepo) GetFileByUser(username string) ([]*models.File, error) {
 	return files, nil
 }
 
-func (r *StoreRepo) GetUserByUsername(username string) (*models.User, error) {
+func (r *StoreRepo) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
 	var user models.User
-	err := r.db.QueryRow(`
+	err := r.db.QueryRowContext(ctx, `
 	SELECT id, username, password, created_at
 	FROM users WHERE username = $1
 `, username).Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt)
@@ -166,14 +175,14 @@ func (r *StoreRepo) GetUserByUsername(username string) (*models.User, error) {
 	return &user, nil
 }
 
-func (r *StoreRepo) SaveFile(file *models.File) error {
+func (r *StoreRepo) SaveFile(ctx context.Context, file *models.File) error {
 	query := `
     INSERT INTO files (
         id, name, path, size, username, uploaded_at, 
-        is_dir, folder_id
-    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        is_dir, folder_id, checksum, checksum_md5, tier
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), COALESCE(NULLIF($11, ''), 'hot'))
     `
-	_, err := r.db.Exec(query,
+	_, err := r.db.ExecContext(ctx, query,
 		file.ID,
 		file.Name,
 		file.Path,
@@ -182,14 +191,18 @@ func (r *StoreRepo) SaveFile(file *models.File) error {
 		time.Now(),
 		file.IsDir,
 		file.FolderID,
+		file.Checksum,
+		file.ChecksumMD5,
+		file.Tier,
 	)
 	return err
 }
 
-func (r *StoreRepo) GetFileById(fileID, username string) (*models.File, error) {
+func (r *StoreRepo) GetFileById(ctx context.Context, fileID, username string) (*models.File, error) {
 	file := &models.File{}
-	err := r.db.QueryRow(`
-        SELECT id, name, path, size, username, uploaded_at, is_dir
+	err := r.db.QueryRowContext(ctx, `
+        SELECT id, name, path, size, username, uploaded_at, is_dir, folder_id, COALESCE(blob_hash, ''),
+               COALESCE(checksum, ''), COALESCE(checksum_md5, ''), tier
         FROM files 
         WHERE id = $1 AND username = $2 AND is_dir = false
     `, fileID, username).Scan(
@@ -200,6 +213,11 @@ func (r *StoreRepo) GetFileById(fileID, username string) (*models.File, error) {
 		&file.Username,
 		&file.UploadedAt,
 		&file.IsDir,
+		&file.FolderID,
+		&file.BlobHash,
+		&file.Checksum,
+		&file.ChecksumMD5,
+		&file.Tier,
 	)
 	if err != nil {
 		return nil, err
@@ -207,9 +225,38 @@ func (r *StoreRepo) GetFileById(fileID, username string) (*models.File, error) {
 	return file, nil
 }
 
-func (r *StoreRepo) SaveFolder(folder *models.Folder) error {
+func (r *StoreRepo) GetFolderById(ctx context.Context, folderID, username string) (*models.Folder, error) {
+	folder := &models.Folder{}
+
+	var parentID *string
+
+	err := r.db.QueryRowContext(ctx, `
+        SELECT id, name, parent_id, username, created_at, path_array, size, file_count
+        FROM folders
+        WHERE id = $1 AND username = $2
+    `, folderID, username).Scan(
+		&folder.ID,
+		&folder.Name,
+		&parentID,
+		&folder.Username,
+		&folder.CreatedAt,
+		pq.Array(&folder.PathArray),
+		&folder.Size,
+		&folder.FileCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if parentID != nil {
+		folder.ParentID = *parentID
+	}
+	return folder, nil
+}
+
+func (r *StoreRepo) SaveFolder(ctx context.Context, folder *models.Folder) error {
 	var parentPathArray []string
-	err := r.db.QueryRow(`
+	err := r.db.QueryRowContext(ctx, `
         SELECT COALESCE(path_array, ARRAY[]::VARCHAR[]) 
         FROM folders 
         WHERE id = $1
@@ -225,7 +272,7 @@ func (r *StoreRepo) SaveFolder(folder *models.Folder) error {
     INSERT INTO folders (id, name, parent_id, username, path_array)
     VALUES ($1, $2, $3, $4, $5)
     `
-	_, err = r.db.Exec(query,
+	_, err = r.db.ExecContext(ctx, query,
 		folder.ID,
 		folder.Name,
 		folder.ParentID,
@@ -235,13 +282,678 @@ func (r *StoreRepo) SaveFolder(folder *models.Folder) error {
 	return err
 }
 
-func (r *StoreRepo) DeleteFile(fileID string) error {
+func (r *StoreRepo) DeleteFile(ctx context.Context, fileID string) error {
 	query := `DELETE FROM files WHERE id = $1`
-	_, err := r.db.Exec(query, fileID)
+	_, err := r.db.ExecContext(ctx, query, fileID)
+	return err
+}
+
+// SaveFileBlob records file as a new reference to blob. The blob row stays
+// locked until the file row is committed, so place can safely decide whether
+// the blob object still has to be written without racing DeleteFileBlob.
+func (r *StoreRepo) SaveFileBlob(ctx context.Context, file *models.File, blob *models.Blob, place func(blob *models.Blob) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := saveFileBlob(ctx, tx, file, blob, place); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func saveFileBlob(ctx context.Context, tx *sqlx.Tx, file *models.File, blob *models.Blob, place func(blob *models.Blob) error) error {
+	_, err := tx.ExecContext(ctx, `
+    INSERT INTO blobs (hash, path, size)
+    VALUES ($1, $2, $3)
+    ON CONFLICT (hash) DO NOTHING
+    `, blob.Hash, blob.Path, blob.Size)
+	if err != nil {
+		return fmt.Errorf("insert blob: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+    SELECT path, size, ref_count, created_at
+    FROM blobs
+    WHERE hash = $1
+    FOR UPDATE
+    `, blob.Hash).Scan(&blob.Path, &blob.Size, &blob.RefCount, &blob.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("lock blob: %w", err)
+	}
+
+	// The file goes in before the content is placed, so a name taken in the
+	// folder fails the upload without leaving a blob object behind.
+	_, err = tx.ExecContext(ctx, `
+    INSERT INTO files (
+        id, name, path, size, username, uploaded_at,
+        is_dir, folder_id, blob_hash, checksum, checksum_md5, tier
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), NULLIF($11, ''), COALESCE(NULLIF($12, ''), 'hot'))
+    `,
+		file.ID,
+		file.Name,
+		blob.Path,
+		file.Size,
+		file.Username,
+		time.Now(),
+		file.IsDir,
+		file.FolderID,
+		blob.Hash,
+		file.Checksum,
+		file.ChecksumMD5,
+		file.Tier,
+	)
+	if err != nil {
+		return fmt.Errorf("insert file: %w", err)
+	}
+
+	if err := place(blob); err != nil {
+		return err
+	}
+	file.Path = blob.Path
+
+	// place decides the tier.
+	_, err = tx.ExecContext(ctx, `UPDATE files SET tier = COALESCE(NULLIF($1, ''), 'hot') WHERE id = $2`, file.Tier, file.ID)
+	if err != nil {
+		return fmt.Errorf("update file tier: %w", err)
+	}
+	return nil
+}
+
+// DeleteFileBlob removes the file row and, when it held the last reference,
+// calls remove with the blob before the blob row is dropped. If remove fails
+// the whole deletion is rolled back.
+func (r *StoreRepo) DeleteFileBlob(ctx context.Context, fileID string, remove func(blob *models.Blob) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	blob := &models.Blob{}
+	err = tx.QueryRowContext(ctx, `DELETE FROM files WHERE id = $1 RETURNING COALESCE(blob_hash, '')`, fileID).Scan(&blob.Hash)
+	if err != nil {
+		return fmt.Errorf("delete file: %w", err)
+	}
+
+	if blob.Hash == "" {
+		return tx.Commit()
+	}
+
+	err = tx.QueryRowContext(ctx, `
+    DELETE FROM blobs
+    WHERE hash = $1 AND ref_count <= 0
+    RETURNING path, size, ref_count, created_at
+    `, blob.Hash).Scan(&blob.Path, &blob.Size, &blob.RefCount, &blob.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("delete blob: %w", err)
+	}
+
+	if err := remove(blob); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *StoreRepo) GetAllFiles(ctx context.Context) ([]*models.File, error) {
+	rows, err := r.db.QueryContext(ctx, `
+    SELECT id, name, path, size, username, folder_id, COALESCE(blob_hash, ''), COALESCE(checksum, '')
+    FROM files
+    WHERE is_dir IS NOT TRUE
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*models.File
+	for rows.Next() {
+		file := &models.File{}
+		if err := rows.Scan(
+			&file.ID,
+			&file.Name,
+			&file.Path,
+			&file.Size,
+			&file.Username,
+			&file.FolderID,
+			&file.BlobHash,
+			&file.Checksum,
+		); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+func (r *StoreRepo) GetBlobs(ctx context.Context) ([]*models.Blob, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT hash, path, size, ref_count, created_at FROM blobs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []*models.Blob
+	for rows.Next() {
+		blob := &models.Blob{}
+		if err := rows.Scan(&blob.Hash, &blob.Path, &blob.Size, &blob.RefCount, &blob.CreatedAt); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+// DeleteUnreferencedBlob calls remove for a blob that no file references and
+// then drops its row. The row is created if missing so that it can be locked:
+// an upload deduplicating onto the same hash waits until the object is gone
+// and then stores it again. It reports false if the blob is still in use.
+func (r *StoreRepo) DeleteUnreferencedBlob(ctx context.Context, blob *models.Blob, remove func(blob *models.Blob) error) (bool, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+    INSERT INTO blobs (hash, path, size)
+    VALUES ($1, $2, $3)
+    ON CONFLICT (hash) DO NOTHING
+    `, blob.Hash, blob.Path, blob.Size)
+	if err != nil {
+		return false, fmt.Errorf("insert blob: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+    SELECT path, ref_count
+    FROM blobs
+    WHERE hash = $1
+    FOR UPDATE
+    `, blob.Hash).Scan(&blob.Path, &blob.RefCount)
+	if err != nil {
+		return false, fmt.Errorf("lock blob: %w", err)
+	}
+
+	if blob.RefCount > 0 {
+		return false, nil
+	}
+
+	if err := remove(blob); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM blobs WHERE hash = $1`, blob.Hash); err != nil {
+		return false, fmt.Errorf("delete blob: %w", err)
+	}
+
+	return true, tx.Commit()
+}
+
+func (r *StoreRepo) GetMigratedObjects(ctx context.Context) (map[string]*models.MigratedObject, error) {
+	var objects []*models.MigratedObject
+	if err := r.db.SelectContext(ctx, &objects, `SELECT path, new_path, size, checksum, migrated_at FROM storage_migrations`); err != nil {
+		return nil, err
+	}
+
+	migrated := make(map[string]*models.MigratedObject, len(objects))
+	for _, obj := range objects {
+		migrated[obj.Path] = obj
+	}
+	return migrated, nil
+}
+
+func (r *StoreRepo) SaveMigratedObject(ctx context.Context, obj *models.MigratedObject) error {
+	_, err := r.db.ExecContext(ctx, `
+    INSERT INTO storage_migrations (path, new_path, size, checksum)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (path) DO UPDATE
+    SET new_path = EXCLUDED.new_path,
+        size = EXCLUDED.size,
+        checksum = EXCLUDED.checksum,
+        migrated_at = CURRENT_TIMESTAMP
+    `, obj.Path, obj.NewPath, obj.Size, obj.Checksum)
+	return err
+}
+
+// RewriteMigratedPaths points files and blobs at the keys their objects were
+// migrated to and clears the progress table, all in one transaction.
+func (r *StoreRepo) RewriteMigratedPaths(ctx context.Context) (int64, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+    UPDATE files f
+    SET path = m.new_path
+    FROM storage_migrations m
+    WHERE f.path = m.path AND m.new_path <> m.path
+    `)
+	if err != nil {
+		return 0, fmt.Errorf("rewrite file paths: %w", err)
+	}
+	rewritten, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE blobs b
+    SET path = m.new_path
+    FROM storage_migrations m
+    WHERE b.path = m.path AND m.new_path <> m.path
+    `)
+	if err != nil {
+		return 0, fmt.Errorf("rewrite blob paths: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM storage_migrations`); err != nil {
+		return 0, fmt.Errorf("clear migration progress: %w", err)
+	}
+
+	return rewritten, tx.Commit()
+}
+
+func (r *StoreRepo) TouchFile(ctx context.Context, fileID string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE files SET last_accessed_at = $1 WHERE id = $2`, time.Now(), fileID)
+	return err
+}
+
+// GetIdlePaths returns the stored paths on tier that no file pointing at them
+// has accessed since before. Files never downloaded count from their upload.
+func (r *StoreRepo) GetIdlePaths(ctx context.Context, tier string, before time.Time) ([]string, error) {
+	var paths []string
+	err := r.db.SelectContext(ctx, &paths, `
+    SELECT path
+    FROM files
+    WHERE is_dir IS NOT TRUE
+    GROUP BY path
+    HAVING bool_and(tier = $1) AND max(COALESCE(last_accessed_at, uploaded_at)) < $2
+    `, tier, before)
+	return paths, err
+}
+
+// MoveFilesTier points every file and blob stored at oldPath to newPath on
+// tier. The rows are locked while move copies the object, so no file can be
+// added to or removed from the old object halfway. It returns the number of
+// files moved; move is not called when there are none.
+func (r *StoreRepo) MoveFilesTier(ctx context.Context, oldPath, newPath, tier string, move func() error) (int64, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Uploads deduplicating onto the blob lock its row first, so it is
+	// locked here before the files to keep the same order.
+	if _, err := tx.ExecContext(ctx, `SELECT hash FROM blobs WHERE path = $1 FOR UPDATE`, oldPath); err != nil {
+		return 0, fmt.Errorf("lock blob: %w", err)
+	}
+
+	var ids []string
+	if err := tx.SelectContext(ctx, &ids, `SELECT id FROM files WHERE path = $1 FOR UPDATE`, oldPath); err != nil {
+		return 0, fmt.Errorf("lock files: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if err := move(); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx, `UPDATE files SET path = $1, tier = $2 WHERE path = $3`, newPath, tier, oldPath)
+	if err != nil {
+		return 0, fmt.Errorf("update files: %w", err)
+	}
+	moved, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE blobs SET path = $1 WHERE path = $2`, newPath, oldPath); err != nil {
+		return 0, fmt.Errorf("update blob: %w", err)
+	}
+
+	return moved, tx.Commit()
+}
+
+// GetFileByName returns the file called name in folderID, compared
+// case-insensitively. Like idx_files_folder_id_name it counts rows whose
+// is_dir is NULL as files.
+func (r *StoreRepo) GetFileByName(ctx context.Context, folderID, name string) (*models.File, error) {
+	file := &models.File{}
+	err := r.db.GetContext(ctx, file, `
+        SELECT id, name, path, size, username, uploaded_at, COALESCE(is_dir, false) AS is_dir, folder_id
+        FROM files
+        WHERE folder_id = $1 AND LOWER(name) = LOWER($2) AND is_dir IS NOT TRUE
+        LIMIT 1
+    `, folderID, name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (r *StoreRepo) GetFolderByName(ctx context.Context, parentID, name string) (*models.Folder, error) {
+	folder := &models.Folder{}
+	err := r.db.QueryRowContext(ctx, `
+        SELECT id, name, parent_id, username, created_at
+        FROM folders
+        WHERE parent_id = $1 AND LOWER(name) = LOWER($2)
+    `, parentID, name).Scan(
+		&folder.ID,
+		&folder.Name,
+		&folder.ParentID,
+		&folder.Username,
+		&folder.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+func (r *StoreRepo) RenameFile(ctx context.Context, fileID, name string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE files SET name = $1 WHERE id = $2`, name, fileID)
+	return err
+}
+
+func (r *StoreRepo) RenameFolder(ctx context.Context, folderID, name string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE folders SET name = $1 WHERE id = $2`, name, folderID)
+	return err
+}
+
+// GetSubtreeFiles returns the files of a folder and all its subfolders.
+func (r *StoreRepo) GetSubtreeFiles(ctx context.Context, folderID string) ([]*models.File, error) {
+	var files []*models.File
+	err := r.db.SelectContext(ctx, &files, `
+        SELECT fi.id, fi.name, fi.path, fi.size, fi.username, fi.uploaded_at, fi.folder_id,
+               COALESCE(fi.blob_hash, '') AS blob_hash, COALESCE(fi.checksum, '') AS checksum,
+               COALESCE(fi.checksum_md5, '') AS checksum_md5, fi.tier
+        FROM files fi
+        JOIN folders fo ON fo.id = fi.folder_id
+        WHERE (fo.id = $1 OR $1 = ANY(fo.path_array)) AND fi.is_dir IS NOT TRUE
+    `, folderID)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetSubtreeFolders returns a folder and all its subfolders, parents before
+// their children.
+func (r *StoreRepo) GetSubtreeFolders(ctx context.Context, folderID string) ([]*models.Folder, error) {
+	rows, err := r.db.QueryContext(ctx, `
+        SELECT id, name, COALESCE(parent_id, ''), username, created_at, path_array
+        FROM folders
+        WHERE id = $1 OR $1 = ANY(path_array)
+        ORDER BY cardinality(path_array)
+    `, folderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []*models.Folder
+	for rows.Next() {
+		folder := &models.Folder{}
+		err := rows.Scan(
+			&folder.ID,
+			&folder.Name,
+			&folder.ParentID,
+			&folder.Username,
+			&folder.CreatedAt,
+			pq.Array(&folder.PathArray),
+		)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// DeleteEmptyFolder deletes a folder and its subfolders if none of them holds
+// a file anymore, and reports whether it did. The folders stay locked until
+// the deletion commits, so no file can be added to them meanwhile.
+func (r *StoreRepo) DeleteEmptyFolder(ctx context.Context, folderID string) (bool, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var ids []string
+	err = tx.SelectContext(ctx, &ids, `SELECT id FROM folders WHERE id = $1 OR $1 = ANY(path_array) FOR UPDATE`, folderID)
+	if err != nil {
+		return false, fmt.Errorf("lock folders: %w", err)
+	}
+	if len(ids) == 0 {
+		return false, sql.ErrNoRows
+	}
+
+	var hasFiles bool
+	err = tx.GetContext(ctx, &hasFiles, `SELECT EXISTS (SELECT 1 FROM files WHERE folder_id = ANY($1))`, pq.Array(ids))
+	if err != nil {
+		return false, fmt.Errorf("check files: %w", err)
+	}
+	if hasFiles {
+		return false, nil
+	}
+
+	// Subfolders and pending upload sessions go with it by cascade.
+	if _, err := tx.ExecContext(ctx, `DELETE FROM folders WHERE id = $1`, folderID); err != nil {
+		return false, fmt.Errorf("delete folders: %w", err)
+	}
+
+	return true, tx.Commit()
+}
+
+// MoveFile lists a file in folderID and stores it at newPath. move is called
+// with the file row locked when the path changes, so it can relocate the
+// object before the change is committed.
+func (r *StoreRepo) MoveFile(ctx context.Context, fileID, folderID, newPath string, move func(oldPath string) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldPath string
+	if err := tx.GetContext(ctx, &oldPath, `SELECT path FROM files WHERE id = $1 FOR UPDATE`, fileID); err != nil {
+		return fmt.Errorf("lock file: %w", err)
+	}
+
+	if oldPath != newPath {
+		if err := move(oldPath); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE files SET folder_id = $1, path = $2 WHERE id = $3`, folderID, newPath, fileID)
+	if err != nil {
+		return fmt.Errorf("update file: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// MoveFolder makes parentID the parent of a folder and rewrites path_array
+// for the whole subtree. Moves of the same user's folders run one at a time.
+// check is called with both folders locked and can veto the move. The
+// subtree's usage moves from the old ancestors to the new ones.
+func (r *StoreRepo) MoveFolder(ctx context.Context, folderID, parentID string, check func(folder, parent *models.Folder) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	lock := func(id string) (*models.Folder, error) {
+		folder := &models.Folder{}
+		var parentID *string
+		err := tx.QueryRowContext(ctx, `
+        SELECT id, name, parent_id, username, path_array, size, file_count
+        FROM folders
+        WHERE id = $1
+        FOR UPDATE
+        `, id).Scan(
+			&folder.ID,
+			&folder.Name,
+			&parentID,
+			&folder.Username,
+			pq.Array(&folder.PathArray),
+			&folder.Size,
+			&folder.FileCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if parentID != nil {
+			folder.ParentID = *parentID
+		}
+		return folder, nil
+	}
+
+	// Moves of one user are serialized: moving A below a subfolder of B
+	// while B moves below a subfolder of A locks four different rows, and
+	// each check would pass on path arrays the other move is rewriting.
+	// The lock is held until the transaction ends; the rows below are read
+	// after it is taken.
+	_, err = tx.ExecContext(ctx, `
+    SELECT pg_advisory_xact_lock(hashtext(username)) FROM folders WHERE id = $1
+    `, folderID)
+	if err != nil {
+		return fmt.Errorf("lock folder moves: %w", err)
+	}
+
+	// Concurrent moves lock the two folders in the same order.
+	first, second := folderID, parentID
+	if first > second {
+		first, second = second, first
+	}
+	locked := make(map[string]*models.Folder, 2)
+	for _, id := range []string{first, second} {
+		folder, err := lock(id)
+		if err != nil {
+			return fmt.Errorf("lock folder %s: %w", id, err)
+		}
+		locked[id] = folder
+	}
+
+	folder, parent := locked[folderID], locked[parentID]
+	if err := check(folder, parent); err != nil {
+		return err
+	}
+
+	newPathArray := append(append([]string{}, parent.PathArray...), parent.ID)
+
+	// Descendants keep everything from the moved folder on.
+	_, err = tx.ExecContext(ctx, `
+    UPDATE folders
+    SET path_array = $1::VARCHAR[] || path_array[$2:]
+    WHERE $3 = ANY(path_array)
+    `, pq.Array(newPathArray), len(folder.PathArray)+1, folder.ID)
+	if err != nil {
+		return fmt.Errorf("update descendants: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE folders SET parent_id = $1, path_array = $2 WHERE id = $3
+    `, parent.ID, pq.Array(newPathArray), folder.ID)
+	if err != nil {
+		return fmt.Errorf("update folder: %w", err)
+	}
+
+	if folder.Size != 0 || folder.FileCount != 0 {
+		_, err = tx.ExecContext(ctx, `
+        SELECT add_folder_usage($1, -$3::BIGINT, -$4::BIGINT), add_folder_usage($2, $3, $4)
+        `, folder.ParentID, parent.ID, folder.Size, folder.FileCount)
+		if err != nil {
+			return fmt.Errorf("move folder usage: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *StoreRepo) SaveUploadSession(ctx context.Context, session *models.UploadSession) error {
+	_, err := r.db.ExecContext(ctx, `
+    INSERT INTO upload_sessions (id, username, folder_id, name, path, size, expires_at, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    `,
+		session.ID,
+		session.Username,
+		session.FolderID,
+		session.Name,
+		session.Path,
+		session.Size,
+		session.ExpiresAt,
+		session.CreatedAt,
+	)
 	return err
 }
 
-func (r *StoreRepo) GetFolderHierarchy(username string) ([]*models.Folder, error) {
+func (r *StoreRepo) GetUploadSession(ctx context.Context, id string) (*models.UploadSession, error) {
+	session := &models.UploadSession{}
+	err := r.db.GetContext(ctx, session, `
+    SELECT id, username, folder_id, name, path, size, expires_at, created_at
+    FROM upload_sessions
+    WHERE id = $1
+    `, id)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// FinishUploadSession deletes the session and records its file as a
+// reference to blob, as SaveFileBlob does, in one transaction, so a session
+// can only be finalized once.
+func (r *StoreRepo) FinishUploadSession(ctx context.Context, sessionID string, file *models.File, blob *models.Blob, place func(blob *models.Blob) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM upload_sessions WHERE id = $1`, sessionID)
+	if err != nil {
+		return fmt.Errorf("delete upload session: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := saveFileBlob(ctx, tx, file, blob, place); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteExpiredUploadSessions drops sessions that expired before the given
+// time and returns how many there were.
+func (r *StoreRepo) DeleteExpiredUploadSessions(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM upload_sessions WHERE expires_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *StoreRepo) GetFolderHierarchy(ctx context.Context, username string) ([]*models.Folder, error) {
 	query := `
         WITH RECURSIVE folder_hierarchy AS (
 			SELECT
@@ -251,7 +963,9 @@ func (r *StoreRepo) GetFolderHierarchy(username string) ([]*models.Folder, error
 				f.username,
 				f.created_at,
 				0 as level,
-				f.path_array
+				f.path_array,
+				f.size,
+				f.file_count
 			FROM folders f
 			WHERE f.username = $1
 			  AND f.parent_id IS NULL
@@ -265,7 +979,9 @@ func (r *StoreRepo) GetFolderHierarchy(username string) ([]*models.Folder, error
 				f.username,
 				f.created_at,
 				fh.level + 1,
-				f.path_array
+				f.path_array,
+				f.size,
+				f.file_count
 			FROM folders f
 					 JOIN folder_hierarchy fh ON f.parent_id = fh.id
 		)
@@ -276,12 +992,14 @@ func (r *StoreRepo) GetFolderHierarchy(username string) ([]*models.Folder, error
 			username,
 			created_at,
 			level,
-			path_array
+			path_array,
+			size,
+			file_count
 		FROM folder_hierarchy
 		ORDER BY path_array, level;
     `
 
-	rows, err := r.db.Query(query, username)
+	rows, err := r.db.QueryContext(ctx, query, username)
 	if err != nil {
 		return nil, err
 	}
@@ -304,6 +1022,8 @@ func (r *StoreRepo) GetFolderHierarchy(username string) ([]*models.Folder, error
 			&folder.CreatedAt,
 			&level,
 			&pathArrayBytes,
+			&folder.Size,
+			&folder.FileCount,
 		)
 		if err != nil {
 			return nil, err
@@ -333,7 +1053,7 @@ func (r *StoreRepo) GetFolderHierarchy(username string) ([]*models.Folder, error
 	return rootFolders, nil
 }
 
-func (r *StoreRepo) GetCompleteHierarchy(username string) ([]*models.Folder, error) {
+func (r *StoreRepo) GetCompleteHierarchy(ctx context.Context, username string) ([]*models.Folder, error) {
 	query := `
         WITH RECURSIVE folder_hierarchy AS (
             SELECT
@@ -344,6 +1064,8 @@ func (r *StoreRepo) GetCompleteHierarchy(username string) ([]*models.Folder, err
                 f.created_at,
                 0 as level,
                 f.path_array,
+                f.size,
+                f.file_count,
                 f.id::text AS path
             FROM folders f
             WHERE f.username = $1
@@ -359,6 +1081,8 @@ func (r *StoreRepo) GetCompleteHierarchy(username string) ([]*models.Folder, err
                 f.created_at,
                 fh.level + 1,
                 f.path_array,
+                f.size,
+                f.file_count,
                 fh.path || '/' || f.id::text
             FROM folders f
             JOIN folder_hierarchy fh ON f.parent_id = fh.id
@@ -371,6 +1095,8 @@ func (r *StoreRepo) GetCompleteHierarchy(username string) ([]*models.Folder, err
             fh.created_at,
             fh.level,
             fh.path_array,
+            fh.size,
+            fh.file_count,
             f.id AS file_id,
             f.name AS file_name,
             f.path AS file_path,
@@ -383,7 +1109,7 @@ func (r *StoreRepo) GetCompleteHierarchy(username string) ([]*models.Folder, err
         ORDER BY fh.path, fh.level;
     `
 
-	rows, err := r.db.Query(query, username)
+	rows, err := r.db.QueryContext(ctx, query, username)
 	if err != nil {
 		return nil, err
 	}
@@ -411,6 +1137,8 @@ func (r *StoreRepo) GetCompleteHierarchy(username string) ([]*models.Folder, err
 			&folder.CreatedAt,
 			&level,
 			&pathArrayBytes,
+			&folder.Size,
+			&folder.FileCount,
 			&fileID,
 			&fileName,
 			&filePath,
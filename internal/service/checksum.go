@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strunetsdrive/internal/models"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	VerifyOff   = "off"
+	VerifyLog   = "log"
+	VerifyAbort = "abort"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumOptions controls the digests UploadFile records next to the always
+// computed SHA-256, and what DownloadFile does when content no longer matches.
+type ChecksumOptions struct {
+	MD5    bool
+	Verify string
+}
+
+// hashObject reads a stored object and returns its hex SHA-256 and, if MD5
+// checksums are enabled, its hex MD5; the latter is empty otherwise.
+func (s *StoreService) hashObject(ctx context.Context, path string) (string, string, error) {
+	r, err := s.fileStore.Open(ctx, path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open object: %w", err)
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	writers := []io.Writer{hasher}
+
+	var md5Hasher hash.Hash
+	if s.checksums.MD5 {
+		md5Hasher = md5.New()
+		writers = append(writers, md5Hasher)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return "", "", fmt.Errorf("failed to read object: %w", err)
+	}
+
+	var sumMD5 string
+	if md5Hasher != nil {
+		sumMD5 = hex.EncodeToString(md5Hasher.Sum(nil))
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), sumMD5, nil
+}
+
+// verifyingReader hashes a download while it streams. Only reads that cover
+// the file from the first byte onwards can be verified, so any seek away from
+// the current position other than a rewind disables the check.
+type verifyingReader struct {
+	io.ReadSeekCloser
+	file       *models.File
+	abort      bool
+	hash       hash.Hash
+	pos        int64
+	sequential bool
+	verified   bool
+}
+
+func newVerifyingReader(r io.ReadSeekCloser, file *models.File, abort bool) *verifyingReader {
+	return &verifyingReader{
+		ReadSeekCloser: r,
+		file:           file,
+		abort:          abort,
+		hash:           sha256.New(),
+		sequential:     true,
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	if !r.sequential || r.verified {
+		return n, err
+	}
+
+	r.hash.Write(p[:n])
+	r.pos += int64(n)
+
+	// The last bytes are held back on a mismatch so the client sees a
+	// truncated transfer rather than a complete corrupt file.
+	if r.pos >= r.file.Size {
+		r.verified = true
+		if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != r.file.Checksum {
+			logrus.WithFields(logrus.Fields{
+				"fileID":   r.file.ID,
+				"path":     r.file.Path,
+				"expected": r.file.Checksum,
+				"actual":   sum,
+			}).Error("downloaded content does not match stored checksum")
+
+			if r.abort {
+				return 0, ErrChecksumMismatch
+			}
+		}
+	}
+
+	return n, err
+}
+
+func (r *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	if pos == 0 {
+		r.hash.Reset()
+		r.pos = 0
+		r.sequential = true
+		r.verified = false
+	} else if pos != r.pos {
+		r.sequential = false
+	}
+
+	return pos, nil
+}
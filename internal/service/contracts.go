@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"strunetsdrive/internal/models"
+	"time"
 )
 
 type UserRepository interface {
@@ -13,18 +14,56 @@ type UserRepository interface {
 }
 
 type StoreRepository interface {
-	SaveFile(file *models.File) error
-	DeleteFile(fileID string) error
-	SaveFolder(folder *models.Folder) error
-	GetRootFolder(username string) (*models.Folder, error)
-	GetFolderContent(folderID string) (*models.Folder, error)
-	GetFile(id string) (*models.File, error)
-	GetFileByUser(username string) ([]*models.File, error)
-	GetFileById(fileID, username string) (*models.File, error)
-	GetUserByUsername(username string) (*models.User, error)
-	GetCompleteHierarchy(username string) ([]*models.Folder, error)
-	GetFolderHierarchy(username string) ([]*models.Folder, error)
+	SaveFile(ctx context.Context, file *models.File) error
+	DeleteFile(ctx context.Context, fileID string) error
+	SaveFileBlob(ctx context.Context, file *models.File, blob *models.Blob, place func(blob *models.Blob) error) error
+	DeleteFileBlob(ctx context.Context, fileID string, remove func(blob *models.Blob) error) error
+	TouchFile(ctx context.Context, fileID string) error
+	MoveFilesTier(ctx context.Context, oldPath, newPath, tier string, move func() error) (int64, error)
+	SaveFolder(ctx context.Context, folder *models.Folder) error
+	GetRootFolder(ctx context.Context, username string) (*models.Folder, error)
+	GetFolderContent(ctx context.Context, folderID string) (*models.Folder, error)
+	GetFolderById(ctx context.Context, folderID, username string) (*models.Folder, error)
+	GetFile(ctx context.Context, id string) (*models.File, error)
+	GetFileByUser(ctx context.Context, username string) ([]*models.File, error)
+	GetFileById(ctx context.Context, fileID, username string) (*models.File, error)
+	GetFileByName(ctx context.Context, folderID, name string) (*models.File, error)
+	MoveFile(ctx context.Context, fileID, folderID, newPath string, move func(oldPath string) error) error
+	RenameFile(ctx context.Context, fileID, name string) error
+	GetFolderByName(ctx context.Context, parentID, name string) (*models.Folder, error)
+	RenameFolder(ctx context.Context, folderID, name string) error
+	GetSubtreeFiles(ctx context.Context, folderID string) ([]*models.File, error)
+	GetSubtreeFolders(ctx context.Context, folderID string) ([]*models.Folder, error)
+	DeleteEmptyFolder(ctx context.Context, folderID string) (bool, error)
+	MoveFolder(ctx context.Context, folderID, parentID string, check func(folder, parent *models.Folder) error) error
+	GetUserByUsername(ctx context.Context, username string) (*models.User, error)
+	GetCompleteHierarchy(ctx context.Context, username string) ([]*models.Folder, error)
+	GetFolderHierarchy(ctx context.Context, username string) ([]*models.Folder, error)
+	SaveUploadSession(ctx context.Context, session *models.UploadSession) error
+	GetUploadSession(ctx context.Context, id string) (*models.UploadSession, error)
+	FinishUploadSession(ctx context.Context, sessionID string, file *models.File, blob *models.Blob, place func(blob *models.Blob) error) error
 }
+type ReconcileRepository interface {
+	GetAllFiles(ctx context.Context) ([]*models.File, error)
+	GetFile(ctx context.Context, id string) (*models.File, error)
+	DeleteFile(ctx context.Context, fileID string) error
+	GetBlobs(ctx context.Context) ([]*models.Blob, error)
+	DeleteUnreferencedBlob(ctx context.Context, blob *models.Blob, remove func(blob *models.Blob) error) (bool, error)
+	DeleteExpiredUploadSessions(ctx context.Context, before time.Time) (int64, error)
+}
+
+type TieringRepository interface {
+	GetIdlePaths(ctx context.Context, tier string, before time.Time) ([]string, error)
+	MoveFilesTier(ctx context.Context, oldPath, newPath, tier string, move func() error) (int64, error)
+}
+
+type MigrationRepository interface {
+	GetAllFiles(ctx context.Context) ([]*models.File, error)
+	GetMigratedObjects(ctx context.Context) (map[string]*models.MigratedObject, error)
+	SaveMigratedObject(ctx context.Context, obj *models.MigratedObject) error
+	RewriteMigratedPaths(ctx context.Context) (int64, error)
+}
+
 type SessionRepository interface {
 	Create(ctx context.Context, token models.RefreshSession) error
 	GetToken(ctx context.Context, token string) (*models.RefreshSession, error)
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"slices"
+	"strunetsdrive/internal/models"
+	"strunetsdrive/pkg/encrypt"
+	"sync"
+	"time"
+)
+
+// Copy job states. A done job may still list files that failed to copy.
+const (
+	CopyJobRunning = "running"
+	CopyJobDone    = "done"
+	CopyJobFailed  = "failed"
+)
+
+// ErrJobNotFound is returned for unknown or expired copy jobs.
+var ErrJobNotFound = errors.New("job not found")
+
+const (
+	// copySyncLimit is the largest tree, in files, copied before CopyFolder
+	// returns. Larger trees are copied in the background.
+	copySyncLimit = 100
+	// copyJobRetention is how long finished jobs can still be looked up.
+	copyJobRetention = time.Hour
+)
+
+// copyJobs keeps the copy jobs of this process. Jobs do not survive a
+// restart; a copy interrupted by one leaves the part copied so far.
+type copyJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*models.CopyJob
+}
+
+func newCopyJobs() *copyJobs {
+	return &copyJobs{jobs: make(map[string]*models.CopyJob)}
+}
+
+func (j *copyJobs) add(job *models.CopyJob) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for id, old := range j.jobs {
+		if old.FinishedAt != nil && time.Since(*old.FinishedAt) > copyJobRetention {
+			delete(j.jobs, id)
+		}
+	}
+	j.jobs[job.ID] = job
+}
+
+func (j *copyJobs) update(id string, fn func(job *models.CopyJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if job, ok := j.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// get returns a snapshot of a job of username.
+func (j *copyJobs) get(id, username string) (*models.CopyJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok || job.Username != username {
+		return nil, false
+	}
+
+	snapshot := *job
+	snapshot.Failed = slices.Clone(job.Failed)
+	return &snapshot, true
+}
+
+// CopyFolder copies a folder of username with its whole subtree into destID,
+// or into the Root folder when destID is empty. The copy is named newName,
+// the source's name, or "Copy of <name>" next to the source. Its top folder
+// is created before CopyFolder returns; small trees are copied completely,
+// larger ones in the background, so the returned job may still be running.
+func (s *StoreService) CopyFolder(ctx context.Context, username, folderID, destID, newName string) (*models.CopyJob, error) {
+	source, err := s.repo.GetFolderById(ctx, folderID, username)
+	if err != nil {
+		return nil, fmt.Errorf("folder not found: %w", err)
+	}
+	if source.ParentID == "" {
+		return nil, fmt.Errorf("copy: %w", ErrRootFolder)
+	}
+
+	dest, err := s.moveTarget(ctx, username, destID)
+	if err != nil {
+		return nil, err
+	}
+	if dest.ID == source.ID || slices.Contains(dest.PathArray, source.ID) {
+		return nil, ErrFolderCycle
+	}
+
+	if newName == "" {
+		newName = source.Name
+		if dest.ID == source.ParentID {
+			newName = fmt.Sprintf("Copy of %s", source.Name)
+		}
+	}
+	if err := validateName(newName); err != nil {
+		return nil, err
+	}
+
+	folders, err := s.repo.GetSubtreeFolders(ctx, source.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subfolders: %w", err)
+	}
+	if len(folders) == 0 || folders[0].ID != source.ID {
+		return nil, fmt.Errorf("folder not found: %w", sql.ErrNoRows)
+	}
+	files, err := s.repo.GetSubtreeFiles(ctx, source.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folder files: %w", err)
+	}
+
+	top := &models.Folder{
+		ID:       encrypt.GenerateUUID(),
+		Name:     newName,
+		ParentID: dest.ID,
+		Username: username,
+	}
+	if err := s.repo.SaveFolder(ctx, top); err != nil {
+		return nil, fmt.Errorf("failed to create folder: %w", s.folderConflict(ctx, err, dest.ID, newName))
+	}
+
+	job := &models.CopyJob{
+		ID:        encrypt.GenerateUUID(),
+		Username:  username,
+		SourceID:  source.ID,
+		FolderID:  top.ID,
+		Status:    CopyJobRunning,
+		Total:     len(files),
+		CreatedAt: time.Now(),
+	}
+	s.copyJobs.add(job)
+
+	if len(files) <= copySyncLimit {
+		s.copyTree(ctx, job.ID, top, folders, files)
+	} else {
+		go s.copyTree(context.WithoutCancel(ctx), job.ID, top, folders, files)
+	}
+
+	snapshot, _ := s.copyJobs.get(job.ID, username)
+	return snapshot, nil
+}
+
+// GetCopyJob returns the state of a copy job of username.
+func (s *StoreService) GetCopyJob(ctx context.Context, username, jobID string) (*models.CopyJob, error) {
+	job, ok := s.copyJobs.get(jobID, username)
+	if !ok {
+		return nil, fmt.Errorf("copy job %s: %w", jobID, ErrJobNotFound)
+	}
+	return job, nil
+}
+
+// copyTree recreates folders below top, whose first entry is the folder top
+// copies, and copies files into them.
+func (s *StoreService) copyTree(ctx context.Context, jobID string, top *models.Folder, folders []*models.Folder, files []*models.File) {
+	log := logrus.WithFields(logrus.Fields{
+		"job":    jobID,
+		"folder": top.ID,
+	})
+
+	copies := map[string]string{folders[0].ID: top.ID}
+	for _, folder := range folders[1:] {
+		folderCopy := &models.Folder{
+			ID:       encrypt.GenerateUUID(),
+			Name:     folder.Name,
+			ParentID: copies[folder.ParentID],
+			Username: top.Username,
+		}
+		if err := s.repo.SaveFolder(ctx, folderCopy); err != nil {
+			log.WithError(err).Error("folder copy failed")
+			s.finishCopy(jobID, fmt.Errorf("failed to create folder %q: %w", folder.Name, err))
+			return
+		}
+		copies[folder.ID] = folderCopy.ID
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			s.finishCopy(jobID, err)
+			return
+		}
+
+		_, err := s.copyFile(ctx, file, copies[file.FolderID], file.Name)
+		s.copyJobs.update(jobID, func(job *models.CopyJob) {
+			if err != nil {
+				job.Failed = append(job.Failed, &models.FileResult{FileID: file.ID, File: file, Err: err})
+				return
+			}
+			job.Copied++
+		})
+		if err != nil {
+			log.WithError(err).WithField("file", file.ID).Warn("file copy failed")
+		}
+	}
+
+	s.finishCopy(jobID, nil)
+}
+
+func (s *StoreService) finishCopy(jobID string, err error) {
+	now := time.Now()
+	s.copyJobs.update(jobID, func(job *models.CopyJob) {
+		job.Status = CopyJobDone
+		if err != nil {
+			job.Status = CopyJobFailed
+			job.Error = err.Error()
+		}
+		job.FinishedAt = &now
+	})
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"slices"
+	"strunetsdrive/internal/models"
+)
+
+var (
+	// ErrRootFolder is returned for operations a user's Root folder does not
+	// support.
+	ErrRootFolder = errors.New("not supported on the Root folder")
+	// ErrFolderCycle is returned when a folder would be moved below itself.
+	ErrFolderCycle = errors.New("folder cannot be moved into its own subtree")
+	// ErrFolderChanged is returned when files appear in a folder that is
+	// being deleted.
+	ErrFolderChanged = errors.New("folder changed during the operation")
+)
+
+// RenameFolder renames a folder of username. Its parent must not hold another
+// folder of that name.
+func (s *StoreService) RenameFolder(ctx context.Context, username, folderID, name string) (*models.Folder, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
+	folder, err := s.repo.GetFolderById(ctx, folderID, username)
+	if err != nil {
+		return nil, fmt.Errorf("folder not found: %w", err)
+	}
+	if folder.ParentID == "" {
+		return nil, fmt.Errorf("rename: %w", ErrRootFolder)
+	}
+
+	if err := s.repo.RenameFolder(ctx, folder.ID, name); err != nil {
+		return nil, s.folderConflict(ctx, err, folder.ParentID, name)
+	}
+
+	folder.Name = name
+	return folder, nil
+}
+
+// DeleteFolder deletes a folder of username with everything below it. The
+// files go first, one by one, so shared blobs keep their other references.
+// Files that cannot be deleted are returned; the folders then stay, so the
+// deletion can be retried. It returns the number of deleted files.
+func (s *StoreService) DeleteFolder(ctx context.Context, username, folderID string) (int, []*models.FileResult, error) {
+	folder, err := s.repo.GetFolderById(ctx, folderID, username)
+	if err != nil {
+		return 0, nil, fmt.Errorf("folder not found: %w", err)
+	}
+	if folder.ParentID == "" {
+		return 0, nil, fmt.Errorf("delete: %w", ErrRootFolder)
+	}
+
+	files, err := s.repo.GetSubtreeFiles(ctx, folder.ID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list folder files: %w", err)
+	}
+
+	deleted := 0
+	var failed []*models.FileResult
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return deleted, failed, err
+		}
+
+		if err := s.deleteFile(ctx, file); err != nil {
+			logrus.WithError(err).WithField("file", file.ID).Warn("failed to delete file of deleted folder")
+			failed = append(failed, &models.FileResult{FileID: file.ID, File: file, Err: err})
+			continue
+		}
+		deleted++
+	}
+	if len(failed) > 0 {
+		return deleted, failed, nil
+	}
+
+	ok, err := s.repo.DeleteEmptyFolder(ctx, folder.ID)
+	if err != nil {
+		return deleted, nil, fmt.Errorf("failed to delete folder: %w", err)
+	}
+	if !ok {
+		return deleted, nil, fmt.Errorf("delete: %w", ErrFolderChanged)
+	}
+
+	return deleted, nil, nil
+}
+
+// MoveFolder moves a folder of username with its subtree into parentID, or
+// into the Root folder when parentID is empty. The parent must belong to the
+// same user and must not lie within the moved subtree.
+func (s *StoreService) MoveFolder(ctx context.Context, username, folderID, parentID string) (*models.Folder, error) {
+	folder, err := s.repo.GetFolderById(ctx, folderID, username)
+	if err != nil {
+		return nil, fmt.Errorf("folder not found: %w", err)
+	}
+	if folder.ParentID == "" {
+		return nil, fmt.Errorf("move: %w", ErrRootFolder)
+	}
+
+	parent, err := s.moveTarget(ctx, username, parentID)
+	if err != nil {
+		return nil, err
+	}
+	if parent.ID == folder.ParentID {
+		return folder, nil
+	}
+
+	// The folders are checked again once locked, a concurrent move may have
+	// changed them meanwhile.
+	err = s.repo.MoveFolder(ctx, folder.ID, parent.ID, func(folder, parent *models.Folder) error {
+		if folder.Username != username || parent.Username != username {
+			return fmt.Errorf("move: %w", sql.ErrNoRows)
+		}
+		if parent.ID == folder.ID || slices.Contains(parent.PathArray, folder.ID) {
+			return ErrFolderCycle
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to move folder: %w", s.folderConflict(ctx, err, parent.ID, folder.Name))
+	}
+
+	folder.ParentID = parent.ID
+	return folder, nil
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"strunetsdrive/internal/models"
+	"strunetsdrive/pkg/filestore"
+)
+
+// ErrMigrationIncomplete is returned by Finalize while some files still point
+// at objects that have not been copied.
+var ErrMigrationIncomplete = errors.New("migration incomplete")
+
+// MigrationReport summarizes one copy pass.
+type MigrationReport struct {
+	Copied  int
+	Skipped int
+	Failed  []string
+	// Sources is only set by Finalize and lists the source key of every
+	// migrated object, for Cleanup.
+	Sources []string
+}
+
+// Migrator copies every object referenced by the files table from one store
+// to another. Source objects are never modified, so the server can keep
+// serving reads from the source until Finalize has rewritten the paths and
+// the configuration is switched over.
+type Migrator struct {
+	repo   MigrationRepository
+	source filestore.Store
+	target filestore.Store
+	// rewrite maps a source key to its key in the target layout.
+	rewrite func(path string) string
+}
+
+func NewMigrator(repo MigrationRepository, source, target filestore.Store, rewrite func(path string) string) *Migrator {
+	if rewrite == nil {
+		rewrite = func(path string) string { return path }
+	}
+	return &Migrator{repo: repo, source: source, target: target, rewrite: rewrite}
+}
+
+// Migrate copies every object that has no progress record yet. It can be run
+// repeatedly: objects recorded by an earlier, possibly interrupted, run are
+// skipped and files uploaded since are picked up.
+func (m *Migrator) Migrate(ctx context.Context) (*MigrationReport, error) {
+	files, err := m.repo.GetAllFiles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load files: %w", err)
+	}
+
+	migrated, err := m.repo.GetMigratedObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration progress: %w", err)
+	}
+
+	report := &MigrationReport{}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		// Deduplicated files share an object, which only needs one copy.
+		if _, ok := migrated[file.Path]; ok {
+			report.Skipped++
+			continue
+		}
+
+		obj, err := m.copyObject(ctx, file)
+		if err != nil {
+			logrus.WithError(err).WithField("path", file.Path).Warn("migrate: copy failed")
+			report.Failed = append(report.Failed, file.Path)
+			continue
+		}
+
+		if err := m.repo.SaveMigratedObject(ctx, obj); err != nil {
+			return report, fmt.Errorf("failed to record progress for %s: %w", file.Path, err)
+		}
+		migrated[file.Path] = obj
+		report.Copied++
+	}
+
+	return report, nil
+}
+
+// Finalize runs a last copy pass and then points every file at its new key.
+// Uploads must be stopped first, since anything stored after the pass is
+// only in the source.
+func (m *Migrator) Finalize(ctx context.Context) (*MigrationReport, int64, error) {
+	report, err := m.Migrate(ctx)
+	if err != nil {
+		return report, 0, err
+	}
+	if len(report.Failed) > 0 {
+		return report, 0, fmt.Errorf("%w: %d objects failed to copy", ErrMigrationIncomplete, len(report.Failed))
+	}
+
+	// Rewriting the paths clears the progress records, which are the only
+	// list of what the source holds.
+	migrated, err := m.repo.GetMigratedObjects(ctx)
+	if err != nil {
+		return report, 0, fmt.Errorf("failed to load migration progress: %w", err)
+	}
+	for path := range migrated {
+		report.Sources = append(report.Sources, path)
+	}
+
+	rewritten, err := m.repo.RewriteMigratedPaths(ctx)
+	if err != nil {
+		return report, 0, fmt.Errorf("failed to rewrite paths: %w", err)
+	}
+	return report, rewritten, nil
+}
+
+// Cleanup deletes the source objects Finalize reported, which turns the copy
+// into a move. It must only run once nothing reads from the source anymore,
+// and never when source and target store objects in the same place.
+func (m *Migrator) Cleanup(ctx context.Context, sources []string) (int, error) {
+	deleted := 0
+	var errs []error
+	for _, path := range sources {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		if err := m.source.Delete(ctx, path); err != nil {
+			logrus.WithError(err).WithField("path", path).Warn("migrate: failed to delete source object")
+			errs = append(errs, err)
+			continue
+		}
+		deleted++
+	}
+
+	return deleted, errors.Join(errs...)
+}
+
+func (m *Migrator) copyObject(ctx context.Context, file *models.File) (*models.MigratedObject, error) {
+	newPath := m.rewrite(file.Path)
+
+	src, err := m.source.Open(ctx, file.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := m.target.Create(ctx, newPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create target: %w", err)
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hasher), src)
+	if err != nil {
+		dst.Abort()
+		return nil, fmt.Errorf("failed to copy: %w", err)
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if err := checkCopy(file, size, checksum); err != nil {
+		dst.Abort()
+		return nil, err
+	}
+
+	if err := dst.Close(); err != nil {
+		return nil, fmt.Errorf("failed to store target: %w", err)
+	}
+
+	if err := m.verifyTarget(ctx, newPath, size, checksum); err != nil {
+		return nil, err
+	}
+
+	return &models.MigratedObject{
+		Path:     file.Path,
+		NewPath:  newPath,
+		Size:     size,
+		Checksum: checksum,
+	}, nil
+}
+
+// checkCopy compares what was read from the source against the files row,
+// so a damaged source object is not silently carried over.
+func checkCopy(file *models.File, size int64, checksum string) error {
+	if size != file.Size {
+		return fmt.Errorf("%w: source has %d bytes, expected %d", ErrChecksumMismatch, size, file.Size)
+	}
+	if file.Checksum != "" && checksum != file.Checksum {
+		return fmt.Errorf("%w: source sha-256 %s, expected %s", ErrChecksumMismatch, checksum, file.Checksum)
+	}
+	return nil
+}
+
+// verifyTarget reads the stored copy back and compares size and hash.
+func (m *Migrator) verifyTarget(ctx context.Context, path string, size int64, checksum string) error {
+	info, err := m.target.GetObjectInfo(ctx, path)
+	if err != nil {
+		return fmt.Errorf("failed to stat target: %w", err)
+	}
+	if info.Size != size {
+		return fmt.Errorf("%w: target has %d bytes, expected %d", ErrChecksumMismatch, info.Size, size)
+	}
+
+	r, err := m.target.Open(ctx, path)
+	if err != nil {
+		return fmt.Errorf("failed to open target: %w", err)
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return fmt.Errorf("failed to read target: %w", err)
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != checksum {
+		return fmt.Errorf("%w: target sha-256 differs from source", ErrChecksumMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"strunetsdrive/internal/models"
+	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/memory"
+	"sync"
+	"testing"
+)
+
+// fakeMigrationRepo keeps the files table and the storage_migrations
+// progress records in memory. RewriteMigratedPaths clears the records, as
+// StoreRepo does.
+type fakeMigrationRepo struct {
+	mu         sync.Mutex
+	files      []*models.File
+	migrations map[string]*models.MigratedObject
+}
+
+func (r *fakeMigrationRepo) GetAllFiles(ctx context.Context) ([]*models.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := make([]*models.File, len(r.files))
+	for i, file := range r.files {
+		found := *file
+		files[i] = &found
+	}
+	return files, nil
+}
+
+func (r *fakeMigrationRepo) GetMigratedObjects(ctx context.Context) (map[string]*models.MigratedObject, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	migrated := make(map[string]*models.MigratedObject, len(r.migrations))
+	for path, obj := range r.migrations {
+		migrated[path] = obj
+	}
+	return migrated, nil
+}
+
+func (r *fakeMigrationRepo) SaveMigratedObject(ctx context.Context, obj *models.MigratedObject) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.migrations[obj.Path] = obj
+	return nil
+}
+
+func (r *fakeMigrationRepo) RewriteMigratedPaths(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rewritten int64
+	for _, file := range r.files {
+		if obj, ok := r.migrations[file.Path]; ok {
+			file.Path = obj.NewPath
+			rewritten++
+		}
+	}
+	r.migrations = make(map[string]*models.MigratedObject)
+	return rewritten, nil
+}
+
+func putObject(t *testing.T, store filestore.Store, path, content string) *models.File {
+	t.Helper()
+
+	w, err := store.Create(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Create(%s): %v", path, err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("Write(%s): %v", path, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(%s): %v", path, err)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	return &models.File{Path: path, Size: int64(len(content)), Checksum: hex.EncodeToString(sum[:])}
+}
+
+func TestFinalizeThenCleanupMovesObjects(t *testing.T) {
+	ctx := context.Background()
+	source, target := memory.NewStore(), memory.NewStore()
+
+	shared := putObject(t, source, "blobs/aa/bb/shared", "shared content")
+	own := putObject(t, source, "alice/own.txt", "own content")
+	// A deduplicated file points at the same object as shared.
+	copied := *shared
+	repo := &fakeMigrationRepo{
+		files:      []*models.File{shared, own, &copied},
+		migrations: make(map[string]*models.MigratedObject),
+	}
+
+	migrator := NewMigrator(repo, source, target, func(path string) string { return "new/" + path })
+	report, rewritten, err := migrator.Finalize(ctx)
+	if err != nil {
+		t.Fatalf("Finalize: %v", err)
+	}
+	if rewritten != 3 {
+		t.Errorf("rewrote %d files, want 3", rewritten)
+	}
+	if len(report.Sources) != 2 {
+		t.Errorf("Finalize reported sources %v, want both objects", report.Sources)
+	}
+
+	deleted, err := migrator.Cleanup(ctx, report.Sources)
+	if err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("deleted %d source objects, want 2", deleted)
+	}
+	if got := storedPaths(t, source, ""); len(got) != 0 {
+		t.Errorf("source still holds %v after cleanup", got)
+	}
+
+	for _, file := range repo.files {
+		if !strings.HasPrefix(file.Path, "new/") {
+			t.Errorf("file still points at %s", file.Path)
+			continue
+		}
+		if exists, err := target.ObjectExists(ctx, file.Path); err != nil || !exists {
+			t.Errorf("target object %s exists = %v (%v)", file.Path, exists, err)
+		}
+	}
+}
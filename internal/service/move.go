@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"path"
+	"strunetsdrive/internal/models"
+)
+
+// MoveFile lists a file in folderID, or in the Root folder when folderID is
+// empty. Both the file and the folder must belong to username, and the folder
+// must not hold a file of the same name.
+func (s *StoreService) MoveFile(ctx context.Context, username, fileID, folderID string) (*models.File, error) {
+	folder, err := s.moveTarget(ctx, username, folderID)
+	if err != nil {
+		return nil, err
+	}
+	return s.moveFile(ctx, username, fileID, folder)
+}
+
+// BatchMoveFiles moves every file of fileIDs into folderID like MoveFile and
+// reports the outcome of each. It only fails as a whole when the folder
+// cannot be used.
+func (s *StoreService) BatchMoveFiles(ctx context.Context, username string, fileIDs []string, folderID string) ([]*models.FileResult, error) {
+	folder, err := s.moveTarget(ctx, username, folderID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*models.FileResult, 0, len(fileIDs))
+	for _, id := range fileIDs {
+		file, err := s.moveFile(ctx, username, id, folder)
+		results = append(results, &models.FileResult{FileID: id, File: file, Err: err})
+	}
+	return results, nil
+}
+
+func (s *StoreService) moveTarget(ctx context.Context, username, folderID string) (*models.Folder, error) {
+	if folderID == "" {
+		return s.repo.GetRootFolder(ctx, username)
+	}
+
+	folder, err := s.repo.GetFolderById(ctx, folderID, username)
+	if err != nil {
+		return nil, fmt.Errorf("destination folder not found: %w", err)
+	}
+	return folder, nil
+}
+
+func (s *StoreService) moveFile(ctx context.Context, username, fileID string, folder *models.Folder) (*models.File, error) {
+	file, err := s.repo.GetFileById(ctx, fileID, username)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+
+	if file.FolderID == folder.ID {
+		return file, nil
+	}
+
+	if clash, err := s.repo.GetFileByName(ctx, folder.ID, file.Name); err == nil {
+		return nil, &NameConflictError{Kind: "file", ID: clash.ID, Name: clash.Name}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to check name: %w", err)
+	}
+
+	newPath := relocate(file, folder.ID)
+	moved := false
+	err = s.repo.MoveFile(ctx, file.ID, folder.ID, newPath, func(oldPath string) error {
+		if err := s.fileStore.MoveObject(ctx, oldPath, newPath); err != nil {
+			return fmt.Errorf("failed to move file content: %w", err)
+		}
+		moved = true
+		return nil
+	})
+	if err != nil {
+		if moved {
+			if undoErr := s.fileStore.MoveObject(context.WithoutCancel(ctx), newPath, file.Path); undoErr != nil {
+				logrus.WithError(undoErr).WithField("path", newPath).Error("failed to move file content back")
+			}
+		}
+		return nil, fmt.Errorf("failed to move file: %w", s.fileConflict(ctx, err, folder.ID, file.Name))
+	}
+
+	file.FolderID = folder.ID
+	file.Path = newPath
+	return file, nil
+}
+
+// relocate returns the path of file once it is listed in folderID. Blobs and
+// uploads are keyed independently of their folder; only files stored under
+// the legacy "<username>/<folder>/<id>" layout have to follow.
+func relocate(file *models.File, folderID string) string {
+	if file.BlobHash != "" {
+		return file.Path
+	}
+
+	dir := path.Dir(file.Path)
+	if path.Base(dir) != file.FolderID {
+		return file.Path
+	}
+	return path.Join(path.Dir(dir), folderID, path.Base(file.Path))
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"strunetsdrive/internal/models"
+)
+
+var (
+	// ErrNameConflict is returned when the destination folder already holds
+	// an item with the same name, compared case-insensitively.
+	ErrNameConflict = errors.New("name already taken")
+	ErrInvalidName  = errors.New("invalid name")
+)
+
+// NameConflictError names the item an operation clashed with. It matches
+// ErrNameConflict.
+type NameConflictError struct {
+	// Kind is "file" or "folder".
+	Kind string
+	ID   string
+	Name string
+}
+
+func (e *NameConflictError) Error() string {
+	return fmt.Sprintf("%s: %s %q already exists (%s)", ErrNameConflict, e.Kind, e.Name, e.ID)
+}
+
+func (e *NameConflictError) Unwrap() error {
+	return ErrNameConflict
+}
+
+// uniqueViolation is the SQLSTATE of a unique constraint violation.
+const uniqueViolation = "23505"
+
+func isUniqueViolation(err error) bool {
+	var state interface{ SQLState() string }
+	return errors.As(err, &state) && state.SQLState() == uniqueViolation
+}
+
+// fileConflict turns a unique violation caused by naming a file name in
+// folderID into a NameConflictError. Other errors are returned unchanged.
+func (s *StoreService) fileConflict(ctx context.Context, err error, folderID, name string) error {
+	if !isUniqueViolation(err) {
+		return err
+	}
+
+	clash, lookupErr := s.repo.GetFileByName(ctx, folderID, name)
+	if lookupErr != nil {
+		return fmt.Errorf("%w: %v", ErrNameConflict, err)
+	}
+	return &NameConflictError{Kind: "file", ID: clash.ID, Name: clash.Name}
+}
+
+// folderConflict is fileConflict for folders.
+func (s *StoreService) folderConflict(ctx context.Context, err error, parentID, name string) error {
+	if !isUniqueViolation(err) {
+		return err
+	}
+
+	clash, lookupErr := s.repo.GetFolderByName(ctx, parentID, name)
+	if lookupErr != nil {
+		return fmt.Errorf("%w: %v", ErrNameConflict, err)
+	}
+	return &NameConflictError{Kind: "folder", ID: clash.ID, Name: clash.Name}
+}
+
+func validateName(name string) error {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return fmt.Errorf("%w: name is empty", ErrInvalidName)
+	case len(name) > 255:
+		return fmt.Errorf("%w: name is longer than 255 bytes", ErrInvalidName)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("%w: %q contains a path separator", ErrInvalidName, name)
+	case name == "." || name == "..":
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// RenameFile renames a file of username. The file's folder must not hold
+// another file of that name.
+func (s *StoreService) RenameFile(ctx context.Context, username, fileID, name string) (*models.File, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+
+	file, err := s.repo.GetFileById(ctx, fileID, username)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+
+	if err := s.repo.RenameFile(ctx, file.ID, name); err != nil {
+		return nil, s.fileConflict(ctx, err, file.FolderID, name)
+	}
+
+	file.Name = name
+	return file, nil
+}
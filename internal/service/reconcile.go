@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"path"
+	"strunetsdrive/internal/models"
+	"strunetsdrive/pkg/filestore"
+	"time"
+)
+
+// ReconcileReport lists the differences found between the files table and
+// the object store.
+type ReconcileReport struct {
+	// OrphanObjects are stored objects that no files or blobs row points at.
+	OrphanObjects []string
+	// UnreferencedBlobs are blob rows left without files, e.g. after a folder
+	// was deleted through a cascade.
+	UnreferencedBlobs []string
+	// MissingObjects are files rows whose object is gone.
+	MissingObjects []*models.File
+	// Repaired counts the objects and rows removed in repair mode.
+	Repaired int
+	// Failed collects the items that could not be repaired.
+	Failed []string
+}
+
+// Reconciler finds storage objects without files rows and rows without
+// objects. In repair mode it deletes both: an orphan object cannot be shown
+// to anyone and a row without an object cannot be downloaded.
+type Reconciler struct {
+	repo      ReconcileRepository
+	fileStore filestore.Store
+	// grace keeps objects younger than this out of the orphan report, since
+	// uploads place their object before the row is committed.
+	grace time.Duration
+}
+
+func NewReconciler(repo ReconcileRepository, fileStore filestore.Store, grace time.Duration) *Reconciler {
+	return &Reconciler{repo: repo, fileStore: fileStore, grace: grace}
+}
+
+func (r *Reconciler) Reconcile(ctx context.Context, repair bool) (*ReconcileReport, error) {
+	// Rows are loaded before objects are listed: an upload places its object
+	// before committing its row, so every row seen here has its object in the
+	// listing unless it was deleted in between, which is re-checked below.
+	files, err := r.repo.GetAllFiles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load files: %w", err)
+	}
+
+	blobs, err := r.repo.GetBlobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load blobs: %w", err)
+	}
+
+	referenced := make(map[string]bool, len(files)+len(blobs))
+	for _, file := range files {
+		referenced[file.Path] = true
+	}
+	for _, blob := range blobs {
+		if blob.RefCount > 0 {
+			referenced[blob.Path] = true
+		}
+	}
+
+	report := &ReconcileReport{}
+	stored := make(map[string]bool)
+	cutoff := time.Now().Add(-r.grace)
+	err = filestore.Walk(ctx, r.fileStore, "", func(obj filestore.ObjectInfo) error {
+		stored[obj.Path] = true
+		if !referenced[obj.Path] && obj.LastModified.Before(cutoff) {
+			report.OrphanObjects = append(report.OrphanObjects, obj.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	for _, blob := range blobs {
+		if blob.RefCount <= 0 && !stored[blob.Path] {
+			report.UnreferencedBlobs = append(report.UnreferencedBlobs, blob.Hash)
+		}
+	}
+
+	for _, file := range files {
+		if stored[file.Path] {
+			continue
+		}
+		missing, err := r.isMissing(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		if missing {
+			report.MissingObjects = append(report.MissingObjects, file)
+		}
+	}
+
+	if repair {
+		r.repair(ctx, report)
+	}
+
+	return report, nil
+}
+
+// isMissing re-checks a row that was absent from the listing, which also
+// happens when the file was deleted while the listing ran.
+func (r *Reconciler) isMissing(ctx context.Context, file *models.File) (bool, error) {
+	if _, err := r.repo.GetFile(ctx, file.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get file %s: %w", file.ID, err)
+	}
+
+	exists, err := r.fileStore.ObjectExists(ctx, file.Path)
+	if err != nil {
+		return false, fmt.Errorf("failed to check object %s: %w", file.Path, err)
+	}
+	return !exists, nil
+}
+
+func (r *Reconciler) repair(ctx context.Context, report *ReconcileReport) {
+	fail := func(item string, err error) {
+		logrus.WithError(err).WithField("item", item).Warn("reconcile: repair failed")
+		report.Failed = append(report.Failed, item)
+	}
+
+	for _, file := range report.MissingObjects {
+		if err := r.repo.DeleteFile(ctx, file.ID); err != nil {
+			fail(file.ID, err)
+			continue
+		}
+		report.Repaired++
+
+		// The row may have held the last reference to its blob.
+		if file.BlobHash != "" {
+			if err := r.removeBlob(ctx, &models.Blob{Hash: file.BlobHash, Path: file.Path}); err != nil {
+				fail(file.BlobHash, err)
+			}
+		}
+	}
+
+	for _, hash := range report.UnreferencedBlobs {
+		if err := r.removeBlob(ctx, &models.Blob{Hash: hash, Path: blobPath(hash)}); err != nil {
+			fail(hash, err)
+			continue
+		}
+		report.Repaired++
+	}
+
+	for _, objectPath := range report.OrphanObjects {
+		var err error
+		if hash, ok := blobHash(objectPath); ok {
+			// Blob objects are removed under the blob row lock, so an upload
+			// deduplicating onto the same content cannot lose its object.
+			err = r.removeBlob(ctx, &models.Blob{Hash: hash, Path: objectPath})
+		} else {
+			err = r.fileStore.Delete(ctx, objectPath)
+		}
+		if err != nil {
+			fail(objectPath, err)
+			continue
+		}
+		report.Repaired++
+	}
+
+	// Expired upload sessions can no longer be finalized; objects uploaded
+	// for them are orphans like any other.
+	expired, err := r.repo.DeleteExpiredUploadSessions(ctx, time.Now())
+	if err != nil {
+		fail("upload sessions", err)
+		return
+	}
+	report.Repaired += int(expired)
+}
+
+func (r *Reconciler) removeBlob(ctx context.Context, blob *models.Blob) error {
+	_, err := r.repo.DeleteUnreferencedBlob(ctx, blob, func(blob *models.Blob) error {
+		return r.fileStore.Delete(ctx, blob.Path)
+	})
+	return err
+}
+
+// blobHash returns the hash of a key produced by blobPath.
+func blobHash(objectPath string) (string, bool) {
+	hash := path.Base(objectPath)
+	if len(hash) != 64 || blobPath(hash) != objectPath {
+		return "", false
+	}
+	return hash, true
+}
+
+// Run reconciles every interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := r.Reconcile(ctx, repair)
+		if err != nil {
+			logrus.WithError(err).Error("reconcile: run failed")
+			continue
+		}
+		report.Log()
+	}
+}
+
+// Log writes a summary line and one line per finding.
+func (report *ReconcileReport) Log() {
+	for _, objectPath := range report.OrphanObjects {
+		logrus.WithField("path", objectPath).Warn("reconcile: object has no files row")
+	}
+	for _, hash := range report.UnreferencedBlobs {
+		logrus.WithField("hash", hash).Warn("reconcile: blob row has no files and no object")
+	}
+	for _, file := range report.MissingObjects {
+		logrus.WithFields(logrus.Fields{
+			"file_id": file.ID,
+			"path":    file.Path,
+		}).Warn("reconcile: files row has no object")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"orphan_objects":     len(report.OrphanObjects),
+		"unreferenced_blobs": len(report.UnreferencedBlobs),
+		"missing_objects":    len(report.MissingObjects),
+		"repaired":           report.Repaired,
+		"failed":             len(report.Failed),
+	}).Info("reconcile: finished")
+}
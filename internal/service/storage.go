@@ -3,13 +3,20 @@ package service
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"hash"
 	"io"
+	"path"
 	"path/filepath"
 	"strunetsdrive/internal/models"
 	"strunetsdrive/pkg/encrypt"
 	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/tiered"
 	"time"
 )
 
@@ -24,15 +31,22 @@ func (b *bufferReadSeekCloser) Close() error {
 type StoreService struct {
 	repo      StoreRepository
 	fileStore filestore.Store
+	checksums ChecksumOptions
+	uploads   UploadOptions
+	copyJobs  *copyJobs
 }
 
-func NewStoreService(repo StoreRepository, fileStore filestore.Store) *StoreService {
-	return &StoreService{repo: repo, fileStore: fileStore}
+func NewStoreService(repo StoreRepository, fileStore filestore.Store, checksums ChecksumOptions, uploads UploadOptions) *StoreService {
+	return &StoreService{repo: repo, fileStore: fileStore, checksums: checksums, uploads: uploads, copyJobs: newCopyJobs()}
 }
 
-func (s *StoreService) CreateFolder(username, folderName, parentID string) (*models.Folder, error) {
+func (s *StoreService) CreateFolder(ctx context.Context, username, folderName, parentID string) (*models.Folder, error) {
+	if err := validateName(folderName); err != nil {
+		return nil, err
+	}
+
 	if parentID == "" {
-		rootFolder, err := s.repo.GetRootFolder(username)
+		rootFolder, err := s.repo.GetRootFolder(ctx, username)
 		if err != nil {
 			return nil, err
 		}
@@ -46,16 +60,20 @@ func (s *StoreService) CreateFolder(username, folderName, parentID string) (*mod
 		Username: username,
 	}
 
-	if err := s.repo.SaveFolder(folder); err != nil {
-		return nil, err
+	if err := s.repo.SaveFolder(ctx, folder); err != nil {
+		return nil, s.folderConflict(ctx, err, parentID, folderName)
 	}
 
 	return folder, nil
 }
 
-func (s *StoreService) UploadFile(username, filename string, content io.Reader, size int64, folderID string) (*models.File, error) {
+func (s *StoreService) UploadFile(ctx context.Context, username, filename string, content io.Reader, size int64, folderID string) (*models.File, error) {
+	if err := validateName(filename); err != nil {
+		return nil, err
+	}
+
 	if folderID == "" {
-		rootFolder, err := s.repo.GetRootFolder(username)
+		rootFolder, err := s.repo.GetRootFolder(ctx, username)
 		if err != nil {
 			return nil, err
 		}
@@ -63,40 +81,107 @@ func (s *StoreService) UploadFile(username, filename string, content io.Reader,
 	}
 
 	id := encrypt.GenerateUUID()
-	path := fmt.Sprintf("%s/%s/%s", username, folderID, id)
+	stagingPath := fmt.Sprintf("%s/tmp/%s", username, id)
 
-	writer, err := s.fileStore.Create(path)
+	writer, err := s.fileStore.Create(ctx, stagingPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file: %w", err)
 	}
-	defer writer.Close()
 
-	written, err := io.CopyN(writer, content, size)
-	if err != nil && err != io.EOF {
+	hasher := sha256.New()
+	writers := []io.Writer{writer, hasher}
+
+	var md5Hasher hash.Hash
+	if s.checksums.MD5 {
+		md5Hasher = md5.New()
+		writers = append(writers, md5Hasher)
+	}
+
+	written, err := io.CopyN(io.MultiWriter(writers...), content, size)
+	if err == io.EOF {
+		err = fmt.Errorf("upload truncated after %d of %d bytes", written, size)
+	}
+	if err != nil {
+		_ = writer.Abort()
 		return nil, fmt.Errorf("failed to copy file content: %w", err)
 	}
 
+	// Close only returns once the backend has the object, so nothing below
+	// records metadata for content that was never stored.
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to store file content: %w", err)
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	blob := &models.Blob{
+		Hash: sum,
+		Path: blobPath(sum),
+		Size: written,
+	}
+
 	fileInfo := &models.File{
 		ID:         id,
 		Name:       filename,
-		Path:       path,
 		Size:       written,
 		Username:   username,
 		FolderID:   folderID,
 		IsDir:      false,
 		UploadedAt: time.Now(),
+		BlobHash:   sum,
+		Checksum:   sum,
+	}
+	if md5Hasher != nil {
+		fileInfo.ChecksumMD5 = hex.EncodeToString(md5Hasher.Sum(nil))
 	}
 
-	if err := s.repo.SaveFile(fileInfo); err != nil {
-		_ = s.fileStore.Delete(path)
-		return nil, fmt.Errorf("failed to save file info: %w", err)
+	err = s.repo.SaveFileBlob(ctx, fileInfo, blob, func(blob *models.Blob) error {
+		fileInfo.Tier = tiered.TierOf(blob.Path)
+		return s.placeBlob(ctx, stagingPath, blob)
+	})
+	if err != nil {
+		// The request may have been cancelled, the staged upload still has
+		// to go.
+		_ = s.fileStore.Delete(context.WithoutCancel(ctx), stagingPath)
+		return nil, fmt.Errorf("failed to save file info: %w", s.fileConflict(ctx, err, folderID, filename))
 	}
 
 	return fileInfo, nil
 }
 
-func (s *StoreService) DownloadFilesAsZip(username string) (io.ReadSeekCloser, error) {
-	files, err := s.repo.GetFileByUser(username)
+// placeBlob moves freshly uploaded content to the blob's content-addressed
+// key, or drops it when an identical object is already stored there.
+func (s *StoreService) placeBlob(ctx context.Context, stagingPath string, blob *models.Blob) error {
+	exists, err := s.fileStore.ObjectExists(ctx, blob.Path)
+	if err != nil {
+		return fmt.Errorf("failed to check blob %s: %w", blob.Hash, err)
+	}
+
+	if !exists {
+		if err := s.fileStore.MoveObject(ctx, stagingPath, blob.Path); err != nil {
+			return fmt.Errorf("failed to store blob %s: %w", blob.Hash, err)
+		}
+		return nil
+	}
+
+	if err := s.fileStore.Delete(ctx, stagingPath); err != nil {
+		logrus.WithError(err).WithField("path", stagingPath).Warn("failed to delete duplicate upload")
+	}
+	return nil
+}
+
+// BlobDir is the top-level directory of the blobs, which are shared by every
+// user holding the same content. Every other key starts with the name of the
+// user it belongs to, so storage layouts can place it per user.
+const BlobDir = "blobs"
+
+// blobPath fans blobs out over two directory levels so no single prefix
+// collects every object.
+func blobPath(hash string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", BlobDir, hash[:2], hash[2:4], hash)
+}
+
+func (s *StoreService) DownloadFilesAsZip(ctx context.Context, username string) (io.ReadSeekCloser, error) {
+	files, err := s.repo.GetFileByUser(ctx, username)
 	if err != nil {
 		return nil, err
 	}
@@ -105,7 +190,7 @@ func (s *StoreService) DownloadFilesAsZip(username string) (io.ReadSeekCloser, e
 	zipWriter := zip.NewWriter(zipBuffer)
 
 	for _, file := range files {
-		reader, _, err := s.DownloadFile(file.ID)
+		reader, _, err := s.DownloadFile(ctx, file.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -130,17 +215,17 @@ func (s *StoreService) DownloadFilesAsZip(username string) (io.ReadSeekCloser, e
 	return &bufferReadSeekCloser{bytes.NewReader(zipBuffer.Bytes())}, nil
 }
 
-func (s *StoreService) DownloadSelectedFilesAsZip(username string, fileIDs []string) (io.ReadSeekCloser, error) {
+func (s *StoreService) DownloadSelectedFilesAsZip(ctx context.Context, username string, fileIDs []string) (io.ReadSeekCloser, error) {
 	zipBuffer := new(bytes.Buffer)
 	zipWriter := zip.NewWriter(zipBuffer)
 
 	for _, fileID := range fileIDs {
-		file, err := s.repo.GetFileById(fileID, username)
+		file, err := s.repo.GetFileById(ctx, fileID, username)
 		if err != nil {
 			return nil, err
 		}
 
-		reader, _, err := s.DownloadFile(file.ID)
+		reader, _, err := s.DownloadFile(ctx, file.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -165,8 +250,8 @@ func (s *StoreService) DownloadSelectedFilesAsZip(username string, fileIDs []str
 	return &bufferReadSeekCloser{bytes.NewReader(zipBuffer.Bytes())}, nil
 }
 
-func (s *StoreService) DownloadFolderAsZip(folderID string) (io.ReadSeekCloser, error) {
-	folderContent, err := s.repo.GetFolderContent(folderID)
+func (s *StoreService) DownloadFolderAsZip(ctx context.Context, folderID string) (io.ReadSeekCloser, error) {
+	folderContent, err := s.repo.GetFolderContent(ctx, folderID)
 	if err != nil {
 		return nil, err
 	}
@@ -185,7 +270,7 @@ func (s *StoreService) DownloadFolderAsZip(folderID string) (io.ReadSeekCloser,
 
 		for _, file := range folder.Files {
 			logrus.WithField("fileID", file.ID).Debug("Adding file to zip")
-			reader, _, err := s.DownloadFile(file.ID)
+			reader, _, err := s.DownloadFile(ctx, file.ID)
 			if err != nil {
 				return err
 			}
@@ -206,7 +291,7 @@ func (s *StoreService) DownloadFolderAsZip(folderID string) (io.ReadSeekCloser,
 		for _, subfolder := range folder.Folders {
 			subfolderPath := filepath.Join(basePath, subfolder.Name)
 
-			subfolderContent, err := s.repo.GetFolderContent(subfolder.ID)
+			subfolderContent, err := s.repo.GetFolderContent(ctx, subfolder.ID)
 			if err != nil {
 				return err
 			}
@@ -233,22 +318,17 @@ func (s *StoreService) DownloadFolderAsZip(folderID string) (io.ReadSeekCloser,
 	return &bufferReadSeekCloser{bytes.NewReader(zipBuffer.Bytes())}, nil
 }
 
-func (s *StoreService) ListFiles(username string) ([]*models.File, error) {
-	return s.repo.GetFileByUser(username)
+func (s *StoreService) ListFiles(ctx context.Context, username string) ([]*models.File, error) {
+	return s.repo.GetFileByUser(ctx, username)
 }
 
-func (s *StoreService) GetFileDownloadURL(fileID string) (string, error) {
-	fileInfo, err := s.repo.GetFile(fileID)
+func (s *StoreService) GetFileDownloadURL(ctx context.Context, fileID string) (string, error) {
+	fileInfo, err := s.repo.GetFile(ctx, fileID)
 	if err != nil {
 		return "", fmt.Errorf("failed to get file info: %w", err)
 	}
 
-	//decryptedPath := encrypt.Decrypt(fileInfo.Path)
-
-	url, err := s.fileStore.(interface {
-		GetPresignedURL(string, time.Duration) (string, error)
-	}).
-		GetPresignedURL(fileInfo.Path, time.Hour)
+	url, err := s.fileStore.GetPresignedURL(ctx, fileInfo.Path, time.Hour)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate download URL: %w", err)
 	}
@@ -256,40 +336,62 @@ func (s *StoreService) GetFileDownloadURL(fileID string) (string, error) {
 	return url, nil
 }
 
-func (s *StoreService) GetFolderContent(id, username string) (*models.Folder, error) {
+func (s *StoreService) GetFolderContent(ctx context.Context, id, username string) (*models.Folder, error) {
 	if id == "" {
-		rootFolder, err := s.repo.GetRootFolder(username)
+		rootFolder, err := s.repo.GetRootFolder(ctx, username)
 		if err != nil {
 			return nil, err
 		}
 		id = rootFolder.ID
 	}
 
-	return s.repo.GetFolderContent(id)
+	return s.repo.GetFolderContent(ctx, id)
 }
 
-func (s *StoreService) GetRootFolder(username string) (*models.Folder, error) {
-	return s.repo.GetRootFolder(username)
+func (s *StoreService) GetRootFolder(ctx context.Context, username string) (*models.Folder, error) {
+	return s.repo.GetRootFolder(ctx, username)
 }
 
-func (s *StoreService) DownloadFile(id string) (io.ReadSeekCloser, *models.File, error) {
-	fileInfo, err := s.repo.GetFile(id)
+func (s *StoreService) DownloadFile(ctx context.Context, id string) (io.ReadSeekCloser, *models.File, error) {
+	fileInfo, err := s.repo.GetFile(ctx, id)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to get file info: %w", err)
 	}
 
-	//decryptedPath := encrypt.Decrypt(fileInfo.Path)
+	if tiered.TierOf(fileInfo.Path) == tiered.TierCold {
+		fileInfo, err = s.recall(ctx, fileInfo)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := s.repo.TouchFile(ctx, id); err != nil {
+		logrus.WithError(err).WithField("file_id", id).Warn("failed to record file access")
+	}
 
-	reader, err := s.fileStore.Open(fileInfo.Path)
+	reader, err := s.fileStore.Open(ctx, fileInfo.Path)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to open file: %w", err)
 	}
 
+	if fileInfo.Checksum != "" && s.checksums.Verify != "" && s.checksums.Verify != VerifyOff {
+		reader = newVerifyingReader(reader, fileInfo, s.checksums.Verify == VerifyAbort)
+	}
+
 	return reader, fileInfo, nil
 }
 
-func (s *StoreService) DeleteFile(username, fileID string) error {
-	fileInfo, err := s.repo.GetFile(fileID)
+func (s *StoreService) GetFileInfo(ctx context.Context, username, fileID string) (*models.File, error) {
+	fileInfo, err := s.repo.GetFileById(ctx, fileID, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	return fileInfo, nil
+}
+
+func (s *StoreService) DeleteFile(ctx context.Context, username, fileID string) error {
+	fileInfo, err := s.repo.GetFile(ctx, fileID)
 	if err != nil {
 		return fmt.Errorf("file not found: %w", err)
 	}
@@ -298,21 +400,114 @@ func (s *StoreService) DeleteFile(username, fileID string) error {
 		return fmt.Errorf("unauthorized to delete this file")
 	}
 
-	if err := s.fileStore.Delete(fileInfo.Path); err != nil {
+	return s.deleteFile(ctx, fileInfo)
+}
+
+// deleteFile removes the object of a file, or its reference to a shared
+// blob, and then its row.
+func (s *StoreService) deleteFile(ctx context.Context, fileInfo *models.File) error {
+	if fileInfo.BlobHash != "" {
+		err := s.repo.DeleteFileBlob(ctx, fileInfo.ID, func(blob *models.Blob) error {
+			if err := s.fileStore.Delete(ctx, blob.Path); err != nil {
+				return fmt.Errorf("failed to delete file from storage: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete file record: %w", err)
+		}
+		return nil
+	}
+
+	if err := s.fileStore.Delete(ctx, fileInfo.Path); err != nil {
 		return fmt.Errorf("failed to delete file from storage: %w", err)
 	}
 
-	if err := s.repo.DeleteFile(fileID); err != nil {
+	if err := s.repo.DeleteFile(ctx, fileInfo.ID); err != nil {
 		return fmt.Errorf("failed to delete file record: %w", err)
 	}
 
 	return nil
 }
 
-func (s *StoreService) GetFolderHierarchy(username string) ([]*models.Folder, error) {
-	return s.repo.GetFolderHierarchy(username)
+// CopyFile duplicates a file into folderID, or next to the source when
+// folderID is empty, named newName or "Copy of <name>". Both the file and the
+// destination folder must belong to username. Deduplicated content only
+// gains a reference; other objects are copied by the storage backend.
+func (s *StoreService) CopyFile(ctx context.Context, username, fileID, folderID, newName string) (*models.File, error) {
+	source, err := s.repo.GetFileById(ctx, fileID, username)
+	if err != nil {
+		return nil, fmt.Errorf("file not found: %w", err)
+	}
+
+	if folderID == "" {
+		folderID = source.FolderID
+	} else if _, err := s.repo.GetFolderById(ctx, folderID, username); err != nil {
+		return nil, fmt.Errorf("destination folder not found: %w", err)
+	}
+
+	if newName == "" {
+		newName = fmt.Sprintf("Copy of %s", source.Name)
+	}
+
+	return s.copyFile(ctx, source, folderID, newName)
+}
+
+func (s *StoreService) copyFile(ctx context.Context, source *models.File, folderID, newName string) (*models.File, error) {
+	fileInfo := &models.File{
+		ID:          encrypt.GenerateUUID(),
+		Name:        newName,
+		Size:        source.Size,
+		Username:    source.Username,
+		FolderID:    folderID,
+		IsDir:       false,
+		UploadedAt:  time.Now(),
+		BlobHash:    source.BlobHash,
+		Checksum:    source.Checksum,
+		ChecksumMD5: source.ChecksumMD5,
+	}
+
+	if source.BlobHash != "" {
+		blob := &models.Blob{Hash: source.BlobHash, Path: source.Path, Size: source.Size}
+		err := s.repo.SaveFileBlob(ctx, fileInfo, blob, func(blob *models.Blob) error {
+			// The source may have lost the last reference meanwhile.
+			exists, err := s.fileStore.ObjectExists(ctx, blob.Path)
+			if err != nil {
+				return fmt.Errorf("failed to check blob %s: %w", blob.Hash, err)
+			}
+			if !exists {
+				return fmt.Errorf("blob %s: %w", blob.Hash, filestore.ErrNotExist)
+			}
+			fileInfo.Tier = tiered.TierOf(blob.Path)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to save file info: %w", s.fileConflict(ctx, err, folderID, newName))
+		}
+		return fileInfo, nil
+	}
+
+	// The object stays next to its source, and so on the source's tier,
+	// whichever folder the copy is listed in.
+	fileInfo.Path = path.Join(path.Dir(source.Path), fileInfo.ID)
+	fileInfo.Tier = tiered.TierOf(fileInfo.Path)
+
+	if err := s.fileStore.CopyObject(ctx, source.Path, fileInfo.Path); err != nil {
+		return nil, fmt.Errorf("failed to copy file content: %w", err)
+	}
+
+	if err := s.repo.SaveFile(ctx, fileInfo); err != nil {
+		_ = s.fileStore.Delete(context.WithoutCancel(ctx), fileInfo.Path)
+		return nil, fmt.Errorf("failed to save file info: %w", s.fileConflict(ctx, err, folderID, newName))
+	}
+
+	return fileInfo, nil
+}
+
+func (s *StoreService) GetFolderHierarchy(ctx context.Context, username string) ([]*models.Folder, error) {
+	return s.repo.GetFolderHierarchy(ctx, username)
 }
 
-func (s *StoreService) GetCompleteHierarchy(username string) ([]*models.Folder, error) {
-	return s.repo.GetCompleteHierarchy(username)
+func (s *StoreService) GetCompleteHierarchy(ctx context.Context, username string) ([]*models.Folder, error) {
+	return s.repo.GetCompleteHierarchy(ctx, username)
 }
@@ -0,0 +1,390 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"strunetsdrive/internal/models"
+	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/memory"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRepo keeps files and blobs in memory the way StoreRepo keeps them in
+// Postgres: a blob is locked from SaveFileBlob's insert until it returns, as
+// by SELECT ... FOR UPDATE, and ref_count follows the files referencing the
+// blob, as the trigger keeps it. Methods the tests do not need are left to
+// the embedded nil interface.
+type fakeRepo struct {
+	StoreRepository
+
+	mu        sync.Mutex
+	files     map[string]*models.File
+	blobs     map[string]*models.Blob
+	blobLocks map[string]*sync.Mutex
+	sessions  map[string]*models.UploadSession
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{
+		files:     make(map[string]*models.File),
+		blobs:     make(map[string]*models.Blob),
+		blobLocks: make(map[string]*sync.Mutex),
+		sessions:  make(map[string]*models.UploadSession),
+	}
+}
+
+func (r *fakeRepo) lockBlob(hash string) func() {
+	r.mu.Lock()
+	lock, ok := r.blobLocks[hash]
+	if !ok {
+		lock = &sync.Mutex{}
+		r.blobLocks[hash] = lock
+	}
+	r.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (r *fakeRepo) SaveFileBlob(ctx context.Context, file *models.File, blob *models.Blob, place func(blob *models.Blob) error) error {
+	defer r.lockBlob(blob.Hash)()
+
+	r.mu.Lock()
+	stored, ok := r.blobs[blob.Hash]
+	if ok {
+		*blob = *stored
+	}
+	r.mu.Unlock()
+
+	if err := place(blob); err != nil {
+		return err
+	}
+	file.Path = blob.Path
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !ok {
+		stored = &models.Blob{Hash: blob.Hash, Path: blob.Path, Size: blob.Size}
+		r.blobs[blob.Hash] = stored
+	}
+	stored.RefCount++
+	saved := *file
+	r.files[file.ID] = &saved
+	return nil
+}
+
+func (r *fakeRepo) DeleteFileBlob(ctx context.Context, fileID string, remove func(blob *models.Blob) error) error {
+	r.mu.Lock()
+	file, ok := r.files[fileID]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("delete file: %w", sql.ErrNoRows)
+	}
+
+	defer r.lockBlob(file.BlobHash)()
+
+	r.mu.Lock()
+	blob := *r.blobs[file.BlobHash]
+	r.mu.Unlock()
+
+	if blob.RefCount <= 1 {
+		if err := remove(&blob); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.files, fileID)
+	if r.blobs[file.BlobHash].RefCount--; r.blobs[file.BlobHash].RefCount <= 0 {
+		delete(r.blobs, file.BlobHash)
+	}
+	return nil
+}
+
+func (r *fakeRepo) GetFile(ctx context.Context, id string) (*models.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file, ok := r.files[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *file
+	return &found, nil
+}
+
+func (r *fakeRepo) GetFileById(ctx context.Context, fileID, username string) (*models.File, error) {
+	file, err := r.GetFile(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if file.Username != username {
+		return nil, sql.ErrNoRows
+	}
+	return file, nil
+}
+
+func (r *fakeRepo) TouchFile(ctx context.Context, fileID string) error {
+	return nil
+}
+
+func (r *fakeRepo) GetRootFolder(ctx context.Context, username string) (*models.Folder, error) {
+	return &models.Folder{ID: "root-" + username, Username: username}, nil
+}
+
+func (r *fakeRepo) GetFileByName(ctx context.Context, folderID, name string) (*models.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, file := range r.files {
+		if file.FolderID == folderID && file.Name == name {
+			found := *file
+			return &found, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *fakeRepo) SaveUploadSession(ctx context.Context, session *models.UploadSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	saved := *session
+	r.sessions[session.ID] = &saved
+	return nil
+}
+
+func (r *fakeRepo) GetUploadSession(ctx context.Context, id string) (*models.UploadSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *session
+	return &found, nil
+}
+
+func (r *fakeRepo) FinishUploadSession(ctx context.Context, sessionID string, file *models.File, blob *models.Blob, place func(blob *models.Blob) error) error {
+	r.mu.Lock()
+	_, ok := r.sessions[sessionID]
+	delete(r.sessions, sessionID)
+	r.mu.Unlock()
+	if !ok {
+		return sql.ErrNoRows
+	}
+	return r.SaveFileBlob(ctx, file, blob, place)
+}
+
+func (r *fakeRepo) refCount(hash string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if blob, ok := r.blobs[hash]; ok {
+		return blob.RefCount
+	}
+	return 0
+}
+
+func newTestService(t *testing.T) (*StoreService, *fakeRepo, filestore.Store) {
+	t.Helper()
+
+	repo := newFakeRepo()
+	store := memory.NewStore()
+	uploads := UploadOptions{BaseURL: "http://drive.test", Secret: []byte("secret"), Expiry: time.Hour}
+	return NewStoreService(repo, store, ChecksumOptions{Verify: VerifyAbort}, uploads), repo, store
+}
+
+func upload(t *testing.T, s *StoreService, username, name, content string) *models.File {
+	t.Helper()
+
+	file, err := s.UploadFile(context.Background(), username, name, strings.NewReader(content), int64(len(content)), "folder")
+	if err != nil {
+		t.Fatalf("UploadFile(%s): %v", name, err)
+	}
+	return file
+}
+
+func download(t *testing.T, s *StoreService, fileID string) string {
+	t.Helper()
+
+	r, _, err := s.DownloadFile(context.Background(), fileID)
+	if err != nil {
+		t.Fatalf("DownloadFile(%s): %v", fileID, err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", fileID, err)
+	}
+	return string(content)
+}
+
+// storedPaths lists every object in store under prefix.
+func storedPaths(t *testing.T, store filestore.Store, prefix string) []string {
+	t.Helper()
+
+	var paths []string
+	err := filestore.Walk(context.Background(), store, prefix, func(obj filestore.ObjectInfo) error {
+		paths = append(paths, obj.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk(%q): %v", prefix, err)
+	}
+	return paths
+}
+
+func TestUploadFileDeduplicatesConcurrentUploads(t *testing.T) {
+	s, repo, store := newTestService(t)
+	const uploads = 8
+	content := strings.Repeat("same content\n", 1000)
+
+	files := make([]*models.File, uploads)
+	errs := make([]error, uploads)
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			files[i], errs[i] = s.UploadFile(context.Background(), fmt.Sprintf("user%d", i), "report.txt",
+				strings.NewReader(content), int64(len(content)), "folder")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("upload %d: %v", i, err)
+		}
+	}
+	for _, file := range files[1:] {
+		if file.Path != files[0].Path || file.BlobHash != files[0].BlobHash {
+			t.Errorf("file %s stored at %s, want the shared blob %s", file.ID, file.Path, files[0].Path)
+		}
+	}
+
+	if got := repo.refCount(files[0].BlobHash); got != uploads {
+		t.Errorf("ref count = %d, want %d", got, uploads)
+	}
+	if got := storedPaths(t, store, "blobs/"); len(got) != 1 {
+		t.Errorf("stored blobs = %v, want exactly one", got)
+	}
+	if got := storedPaths(t, store, "user0/tmp/"); len(got) != 0 {
+		t.Errorf("staged uploads left behind: %v", got)
+	}
+	if got := download(t, s, files[uploads-1].ID); got != content {
+		t.Errorf("downloaded %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestDeleteFileRemovesBlobWithLastReference(t *testing.T) {
+	s, repo, store := newTestService(t)
+	ctx := context.Background()
+
+	first := upload(t, s, "alice", "a.txt", "shared")
+	second := upload(t, s, "bob", "b.txt", "shared")
+
+	if err := s.DeleteFile(ctx, "alice", first.ID); err != nil {
+		t.Fatalf("DeleteFile(first): %v", err)
+	}
+	if got := repo.refCount(second.BlobHash); got != 1 {
+		t.Errorf("ref count after first delete = %d, want 1", got)
+	}
+	if got := download(t, s, second.ID); got != "shared" {
+		t.Errorf("remaining file reads %q, want %q", got, "shared")
+	}
+
+	if err := s.DeleteFile(ctx, "bob", second.ID); err != nil {
+		t.Fatalf("DeleteFile(second): %v", err)
+	}
+	if got := repo.refCount(second.BlobHash); got != 0 {
+		t.Errorf("ref count after last delete = %d, want 0", got)
+	}
+	if exists, err := store.ObjectExists(ctx, second.Path); err != nil || exists {
+		t.Errorf("blob object exists = %v (%v) after its last reference was deleted", exists, err)
+	}
+}
+
+func TestCopyFileSharesBlob(t *testing.T) {
+	s, repo, store := newTestService(t)
+	ctx := context.Background()
+
+	source := upload(t, s, "alice", "a.txt", "copied content")
+	copied, err := s.CopyFile(ctx, "alice", source.ID, "", "")
+	if err != nil {
+		t.Fatalf("CopyFile: %v", err)
+	}
+
+	if copied.Path != source.Path || copied.BlobHash != source.BlobHash {
+		t.Errorf("copy stored at %s, want the source blob %s", copied.Path, source.Path)
+	}
+	if copied.Name != "Copy of a.txt" {
+		t.Errorf("copy named %q, want %q", copied.Name, "Copy of a.txt")
+	}
+	if got := repo.refCount(source.BlobHash); got != 2 {
+		t.Errorf("ref count = %d, want 2", got)
+	}
+	if got := storedPaths(t, store, "blobs/"); len(got) != 1 {
+		t.Errorf("stored blobs = %v, want exactly one", got)
+	}
+
+	if err := s.DeleteFile(ctx, "alice", source.ID); err != nil {
+		t.Fatalf("DeleteFile(source): %v", err)
+	}
+	if got := download(t, s, copied.ID); got != "copied content" {
+		t.Errorf("copy reads %q after deleting the source", got)
+	}
+
+	if err := s.DeleteFile(ctx, "alice", copied.ID); err != nil {
+		t.Fatalf("DeleteFile(copy): %v", err)
+	}
+	if exists, err := store.ObjectExists(ctx, copied.Path); err != nil || exists {
+		t.Errorf("blob object exists = %v (%v) after its last reference was deleted", exists, err)
+	}
+}
+
+func TestFinalizeUploadStoresBlob(t *testing.T) {
+	s, repo, store := newTestService(t)
+	ctx := context.Background()
+	content := "uploaded directly"
+
+	session, err := s.CreateUploadSession(ctx, "alice", "direct.txt", int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("CreateUploadSession: %v", err)
+	}
+	putObject(t, store, session.Path, content)
+
+	file, err := s.FinalizeUpload(ctx, "alice", session.ID)
+	if err != nil {
+		t.Fatalf("FinalizeUpload: %v", err)
+	}
+	if file.BlobHash == "" || file.Path != blobPath(file.BlobHash) {
+		t.Errorf("finalized file stored at %s with blob %q, want its blob path", file.Path, file.BlobHash)
+	}
+	if got := storedPaths(t, store, "alice/"); len(got) != 0 {
+		t.Errorf("staged uploads left behind: %v", got)
+	}
+
+	// The upload URL is still valid, but no longer reaches the file.
+	putObject(t, store, session.Path, "replaced content!")
+	if got := download(t, s, file.ID); got != content {
+		t.Errorf("finalized file reads %q, want %q", got, content)
+	}
+
+	same := upload(t, s, "bob", "copy.txt", content)
+	if same.Path != file.Path {
+		t.Errorf("identical upload stored at %s, want the shared blob %s", same.Path, file.Path)
+	}
+	if got := repo.refCount(file.BlobHash); got != 2 {
+		t.Errorf("ref count = %d, want 2", got)
+	}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strunetsdrive/internal/models"
+	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/tiered"
+	"time"
+)
+
+// Tiering moves objects that no file has been downloaded from for idle to
+// the cold tier. Downloads bring them back through StoreService.
+type Tiering struct {
+	repo      TieringRepository
+	fileStore filestore.Store
+	idle      time.Duration
+}
+
+// NewTiering expects fileStore to route cold keys, i.e. to be or to wrap a
+// tiered.Store.
+func NewTiering(repo TieringRepository, fileStore filestore.Store, idle time.Duration) *Tiering {
+	return &Tiering{repo: repo, fileStore: fileStore, idle: idle}
+}
+
+// Demote moves every idle hot object to the cold tier and returns how many
+// files were moved.
+func (t *Tiering) Demote(ctx context.Context) (int64, error) {
+	paths, err := t.repo.GetIdlePaths(ctx, tiered.TierHot, time.Now().Add(-t.idle))
+	if err != nil {
+		return 0, fmt.Errorf("failed to find idle files: %w", err)
+	}
+
+	var demoted int64
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return demoted, err
+		}
+
+		moved, err := moveTier(ctx, t.repo, t.fileStore, path, tiered.ColdPath(path), tiered.TierCold)
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Warn("tiering: failed to demote object")
+			continue
+		}
+		demoted += moved
+	}
+
+	return demoted, nil
+}
+
+// Run demotes idle objects every interval until ctx is cancelled.
+func (t *Tiering) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		demoted, err := t.Demote(ctx)
+		if err != nil {
+			logrus.WithError(err).Error("tiering: run failed")
+			continue
+		}
+		logrus.WithField("files", demoted).Info("tiering: demoted idle files")
+	}
+}
+
+// recall moves a cold file back to the hot tier before it is served. If the
+// move fails the file is served straight from the cold tier.
+func (s *StoreService) recall(ctx context.Context, file *models.File) (*models.File, error) {
+	_, err := moveTier(ctx, s.repo, s.fileStore, file.Path, tiered.HotPath(file.Path), tiered.TierHot)
+	if err != nil {
+		logrus.WithError(err).WithField("file_id", file.ID).Warn("tiering: failed to recall file")
+		return file, nil
+	}
+
+	// Reload in case a concurrent download recalled the object first.
+	recalled, err := s.repo.GetFile(ctx, file.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+	return recalled, nil
+}
+
+type tierMover interface {
+	MoveFilesTier(ctx context.Context, oldPath, newPath, tier string, move func() error) (int64, error)
+}
+
+// moveTier copies the object at oldPath to newPath while its files are
+// locked, repoints them and then removes the old copy. Until the rows are
+// updated readers keep using the old copy.
+func moveTier(ctx context.Context, repo tierMover, fileStore filestore.Store, oldPath, newPath, tier string) (int64, error) {
+	moved, err := repo.MoveFilesTier(ctx, oldPath, newPath, tier, func() error {
+		return fileStore.CopyObject(ctx, oldPath, newPath)
+	})
+	if err != nil || moved == 0 {
+		return moved, err
+	}
+
+	// The files already point at the new copy, so the old one goes even if
+	// ctx was cancelled meanwhile.
+	if err := fileStore.Delete(context.WithoutCancel(ctx), oldPath); err != nil {
+		logrus.WithError(err).WithField("path", oldPath).Warn("tiering: failed to delete old copy")
+	}
+	return moved, nil
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"strunetsdrive/internal/models"
+	"strunetsdrive/pkg/encrypt"
+	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/tiered"
+	"time"
+)
+
+var (
+	ErrUploadExpired    = errors.New("upload session expired")
+	ErrUploadIncomplete = errors.New("object has not been uploaded")
+	ErrUploadMismatch   = errors.New("uploaded object does not match the session")
+	ErrInvalidSignature = errors.New("invalid upload signature")
+	ErrUploadTooLarge   = errors.New("upload exceeds the maximum size")
+)
+
+// UploadOptions configures direct upload sessions. When the backend cannot
+// presign uploads, clients upload to BaseURL + "/uploads/:id" instead, with
+// a URL signed by Secret.
+type UploadOptions struct {
+	BaseURL string
+	Secret  []byte
+	Expiry  time.Duration
+	MaxSize int64
+}
+
+// CreateUploadSession reserves a file of size bytes and returns a session
+// with the URL the client has to PUT the content to. The file only appears
+// once FinalizeUpload has seen the object.
+func (s *StoreService) CreateUploadSession(ctx context.Context, username, filename string, size int64, folderID string) (*models.UploadSession, error) {
+	if err := validateName(filename); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid upload size %d", size)
+	}
+	if s.uploads.MaxSize > 0 && size > s.uploads.MaxSize {
+		return nil, fmt.Errorf("%w of %d bytes", ErrUploadTooLarge, s.uploads.MaxSize)
+	}
+
+	if folderID == "" {
+		rootFolder, err := s.repo.GetRootFolder(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		folderID = rootFolder.ID
+	} else if _, err := s.repo.GetFolderById(ctx, folderID, username); err != nil {
+		return nil, fmt.Errorf("folder not found: %w", err)
+	}
+
+	// Finalizing would fail on a taken name anyway, but only after the upload.
+	if clash, err := s.repo.GetFileByName(ctx, folderID, filename); err == nil {
+		return nil, &NameConflictError{Kind: "file", ID: clash.ID, Name: clash.Name}
+	}
+
+	now := time.Now()
+	id := encrypt.GenerateUUID()
+	session := &models.UploadSession{
+		ID:        id,
+		Username:  username,
+		FolderID:  folderID,
+		Name:      filename,
+		Path:      fmt.Sprintf("%s/uploads/%s", username, id),
+		Size:      size,
+		ExpiresAt: now.Add(s.uploads.Expiry),
+		CreatedAt: now,
+	}
+
+	uploadURL, err := s.fileStore.GetPresignedPutURL(ctx, session.Path, s.uploads.Expiry)
+	if errors.Is(err, filestore.ErrNotSupported) {
+		uploadURL, err = s.signedUploadURL(session)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload url: %w", err)
+	}
+	session.UploadURL = uploadURL
+
+	if err := s.repo.SaveUploadSession(ctx, session); err != nil {
+		return nil, fmt.Errorf("failed to save upload session: %w", err)
+	}
+
+	return session, nil
+}
+
+func (s *StoreService) signedUploadURL(session *models.UploadSession) (string, error) {
+	if len(s.uploads.Secret) == 0 || s.uploads.BaseURL == "" {
+		return "", fmt.Errorf("signed upload urls are not configured: %w", filestore.ErrNotSupported)
+	}
+
+	expires := session.ExpiresAt.Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", s.signUpload(session.ID, expires))
+
+	return fmt.Sprintf("%s/uploads/%s?%s", strings.TrimSuffix(s.uploads.BaseURL, "/"), session.ID, query.Encode()), nil
+}
+
+func (s *StoreService) signUpload(sessionID string, expires int64) string {
+	mac := hmac.New(sha256.New, s.uploads.Secret)
+	fmt.Fprintf(mac, "%s:%d", sessionID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ReceiveUpload stores the content of a signed upload URL. It stands in for
+// the backend's own presigned uploads and accepts exactly the session's size.
+func (s *StoreService) ReceiveUpload(ctx context.Context, sessionID string, expires int64, signature string, content io.Reader) error {
+	if len(s.uploads.Secret) == 0 || !hmac.Equal([]byte(signature), []byte(s.signUpload(sessionID, expires))) {
+		return ErrInvalidSignature
+	}
+	if time.Now().Unix() > expires {
+		return ErrUploadExpired
+	}
+
+	session, err := s.repo.GetUploadSession(ctx, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get upload session: %w", err)
+	}
+
+	writer, err := s.fileStore.Create(ctx, session.Path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	written, err := io.CopyN(writer, content, session.Size)
+	if err == io.EOF {
+		err = fmt.Errorf("%w: upload truncated after %d of %d bytes", ErrUploadMismatch, written, session.Size)
+	}
+	if err == nil {
+		if n, _ := io.CopyN(io.Discard, content, 1); n > 0 {
+			err = fmt.Errorf("%w: upload is larger than %d bytes", ErrUploadMismatch, session.Size)
+		}
+	}
+	if err != nil {
+		_ = writer.Abort()
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to store file content: %w", err)
+	}
+	return nil
+}
+
+// FinalizeUpload checks that the session's object has been uploaded with the
+// announced size, hashes it and stores it as the blob of a new file.
+func (s *StoreService) FinalizeUpload(ctx context.Context, username, sessionID string) (*models.File, error) {
+	session, err := s.repo.GetUploadSession(ctx, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload session: %w", err)
+	}
+	if session.Username != username {
+		return nil, fmt.Errorf("failed to get upload session: %w", sql.ErrNoRows)
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, ErrUploadExpired
+	}
+
+	// The upload URL stays valid until the session expires. The object is
+	// moved out of its reach first, so what is checked and hashed below
+	// cannot be replaced afterwards.
+	stagingPath := fmt.Sprintf("%s/tmp/%s", username, encrypt.GenerateUUID())
+	if err := s.fileStore.MoveObject(ctx, session.Path, stagingPath); err != nil {
+		if errors.Is(err, filestore.ErrNotExist) {
+			return nil, ErrUploadIncomplete
+		}
+		return nil, fmt.Errorf("failed to stage uploaded object: %w", err)
+	}
+
+	fileInfo, err := s.finalizeStaged(ctx, session, stagingPath)
+	if err != nil {
+		// The request may have been cancelled, the staged upload still has
+		// to go. The client can upload again while the session is valid.
+		_ = s.fileStore.Delete(context.WithoutCancel(ctx), stagingPath)
+		return nil, err
+	}
+
+	return fileInfo, nil
+}
+
+func (s *StoreService) finalizeStaged(ctx context.Context, session *models.UploadSession, stagingPath string) (*models.File, error) {
+	info, err := s.fileStore.GetObjectInfo(ctx, stagingPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check uploaded object: %w", err)
+	}
+	if info.Size != session.Size {
+		return nil, fmt.Errorf("%w: got %d bytes, want %d", ErrUploadMismatch, info.Size, session.Size)
+	}
+
+	// The content never passed through the server, so it is read back once
+	// to record the checksums downloads are verified against.
+	checksum, checksumMD5, err := s.hashObject(ctx, stagingPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash uploaded object: %w", err)
+	}
+
+	blob := &models.Blob{
+		Hash: checksum,
+		Path: blobPath(checksum),
+		Size: info.Size,
+	}
+
+	fileInfo := &models.File{
+		ID:          session.ID,
+		Name:        session.Name,
+		Size:        info.Size,
+		Username:    session.Username,
+		FolderID:    session.FolderID,
+		IsDir:       false,
+		UploadedAt:  time.Now(),
+		BlobHash:    checksum,
+		Checksum:    checksum,
+		ChecksumMD5: checksumMD5,
+	}
+
+	err = s.repo.FinishUploadSession(ctx, session.ID, fileInfo, blob, func(blob *models.Blob) error {
+		fileInfo.Tier = tiered.TierOf(blob.Path)
+		return s.placeBlob(ctx, stagingPath, blob)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save file info: %w", s.fileConflict(ctx, err, fileInfo.FolderID, fileInfo.Name))
+	}
+
+	return fileInfo, nil
+}
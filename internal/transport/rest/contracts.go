@@ -4,22 +4,36 @@ import (
 	"context"
 	"io"
 	"strunetsdrive/internal/models"
+	"strunetsdrive/pkg/filestore/faulty"
 )
 
 type StorageService interface {
-	CreateFolder(username, folderName, parentID string) (*models.Folder, error)
-	UploadFile(username, filename string, content io.Reader, size int64, folderID string) (*models.File, error)
-	DownloadFilesAsZip(username string) (io.ReadSeekCloser, error)
-	DownloadFolderAsZip(folderID string) (io.ReadSeekCloser, error)
-	DownloadSelectedFilesAsZip(username string, fileIDs []string) (io.ReadSeekCloser, error)
-	DownloadFile(id string) (io.ReadSeekCloser, *models.File, error)
-	DeleteFile(username, fileID string) error
-	ListFiles(username string) ([]*models.File, error)
-	GetFileDownloadURL(fileID string) (string, error)
-	GetFolderContent(id, username string) (*models.Folder, error)
-	GetRootFolder(username string) (*models.Folder, error)
-	GetCompleteHierarchy(username string) ([]*models.Folder, error)
-	GetFolderHierarchy(username string) ([]*models.Folder, error)
+	CreateFolder(ctx context.Context, username, folderName, parentID string) (*models.Folder, error)
+	UploadFile(ctx context.Context, username, filename string, content io.Reader, size int64, folderID string) (*models.File, error)
+	DownloadFilesAsZip(ctx context.Context, username string) (io.ReadSeekCloser, error)
+	DownloadFolderAsZip(ctx context.Context, folderID string) (io.ReadSeekCloser, error)
+	DownloadSelectedFilesAsZip(ctx context.Context, username string, fileIDs []string) (io.ReadSeekCloser, error)
+	DownloadFile(ctx context.Context, id string) (io.ReadSeekCloser, *models.File, error)
+	GetFileInfo(ctx context.Context, username, fileID string) (*models.File, error)
+	DeleteFile(ctx context.Context, username, fileID string) error
+	CopyFile(ctx context.Context, username, fileID, folderID, newName string) (*models.File, error)
+	MoveFile(ctx context.Context, username, fileID, folderID string) (*models.File, error)
+	BatchMoveFiles(ctx context.Context, username string, fileIDs []string, folderID string) ([]*models.FileResult, error)
+	RenameFile(ctx context.Context, username, fileID, name string) (*models.File, error)
+	RenameFolder(ctx context.Context, username, folderID, name string) (*models.Folder, error)
+	DeleteFolder(ctx context.Context, username, folderID string) (int, []*models.FileResult, error)
+	MoveFolder(ctx context.Context, username, folderID, parentID string) (*models.Folder, error)
+	CopyFolder(ctx context.Context, username, folderID, destID, newName string) (*models.CopyJob, error)
+	GetCopyJob(ctx context.Context, username, jobID string) (*models.CopyJob, error)
+	ListFiles(ctx context.Context, username string) ([]*models.File, error)
+	GetFileDownloadURL(ctx context.Context, fileID string) (string, error)
+	GetFolderContent(ctx context.Context, id, username string) (*models.Folder, error)
+	GetRootFolder(ctx context.Context, username string) (*models.Folder, error)
+	GetCompleteHierarchy(ctx context.Context, username string) ([]*models.Folder, error)
+	GetFolderHierarchy(ctx context.Context, username string) ([]*models.Folder, error)
+	CreateUploadSession(ctx context.Context, username, filename string, size int64, folderID string) (*models.UploadSession, error)
+	ReceiveUpload(ctx context.Context, sessionID string, expires int64, signature string, content io.Reader) error
+	FinalizeUpload(ctx context.Context, username, sessionID string) (*models.File, error)
 }
 
 type UserService interface {
@@ -28,3 +42,8 @@ type UserService interface {
 	ParseToken(ctx context.Context, token string) (int, string, error)
 	RefreshSession(ctx context.Context, refreshToken string) (string, string, error)
 }
+
+type FaultInjector interface {
+	Rules() []faulty.Rule
+	SetRules(rules []faulty.Rule) error
+}
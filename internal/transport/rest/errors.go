@@ -1,8 +1,15 @@
 package rest
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"strunetsdrive/internal/service"
+	"strunetsdrive/pkg/filestore"
 
+	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 )
 
@@ -95,3 +102,50 @@ func stringifyError(err error) string {
 
 	return ""
 }
+
+// errorStatus maps service errors onto HTTP status codes so a missing file
+// is reported as 404 instead of being mistaken for a storage outage.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, filestore.ErrNotExist), errors.Is(err, service.ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrInvalidName), errors.Is(err, service.ErrRootFolder),
+		errors.Is(err, service.ErrFolderCycle):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrInvalidSignature):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrUploadExpired):
+		return http.StatusGone
+	case errors.Is(err, service.ErrUploadIncomplete), errors.Is(err, service.ErrNameConflict),
+		errors.Is(err, service.ErrFolderChanged):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrUploadMismatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, service.ErrUploadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, filestore.ErrUnavailable), errors.Is(err, context.Canceled):
+		// Cancelled work means the client went away or the server is
+		// shutting down.
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorBody is the response body for a failed operation. Name conflicts also
+// report the item that holds the name.
+func errorBody(message string, err error) gin.H {
+	body := gin.H{
+		"error": fmt.Sprintf("%s: %v", message, err),
+	}
+
+	var conflict *service.NameConflictError
+	if errors.As(err, &conflict) {
+		body["conflict"] = gin.H{
+			"type": conflict.Kind,
+			"id":   conflict.ID,
+			"name": conflict.Name,
+		}
+	}
+	return body
+}
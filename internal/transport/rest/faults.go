@@ -0,0 +1,113 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strunetsdrive/pkg/filestore/faulty"
+	"time"
+)
+
+// FaultHandler lets tests change the storage fault rules of a running
+// server. It is only registered when fault injection is enabled, behind
+// AdminTokenMiddleware.
+type FaultHandler struct {
+	faults FaultInjector
+}
+
+func NewFaultHandler(faults FaultInjector) *FaultHandler {
+	return &FaultHandler{faults: faults}
+}
+
+func (h *FaultHandler) InjectRoutes(r *gin.Engine, middlewares ...gin.HandlerFunc) {
+	faults := r.Group("/admin/faults").Use(middlewares...)
+	{
+		faults.GET("", h.GetRules)
+		faults.PUT("", h.SetRules)
+		faults.DELETE("", h.ClearRules)
+	}
+}
+
+// faultRule is the JSON form of faulty.Rule, with the latency as a duration
+// string such as "250ms".
+type faultRule struct {
+	Op            string  `json:"op,omitempty"`
+	Pattern       string  `json:"pattern,omitempty"`
+	Rate          float64 `json:"rate,omitempty"`
+	Latency       string  `json:"latency,omitempty"`
+	Error         bool    `json:"error,omitempty"`
+	TruncateAfter *int64  `json:"truncate_after,omitempty"`
+	FailClose     bool    `json:"fail_close,omitempty"`
+	Limit         int     `json:"limit,omitempty"`
+}
+
+func (h *FaultHandler) GetRules(c *gin.Context) {
+	rules := h.faults.Rules()
+
+	out := make([]faultRule, 0, len(rules))
+	for _, rule := range rules {
+		r := faultRule{
+			Op:            rule.Op,
+			Pattern:       rule.Pattern,
+			Rate:          rule.Rate,
+			Error:         rule.Error,
+			TruncateAfter: rule.TruncateAfter,
+			FailClose:     rule.FailClose,
+			Limit:         rule.Limit,
+		}
+		if rule.Latency > 0 {
+			r.Latency = rule.Latency.String()
+		}
+		out = append(out, r)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": out})
+}
+
+func (h *FaultHandler) SetRules(c *gin.Context) {
+	var input struct {
+		Rules []faultRule `json:"rules"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rules := make([]faulty.Rule, 0, len(input.Rules))
+	for i, r := range input.Rules {
+		rule := faulty.Rule{
+			Op:            r.Op,
+			Pattern:       r.Pattern,
+			Rate:          r.Rate,
+			Error:         r.Error,
+			TruncateAfter: r.TruncateAfter,
+			FailClose:     r.FailClose,
+			Limit:         r.Limit,
+		}
+		if r.Latency != "" {
+			latency, err := time.ParseDuration(r.Latency)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("rule %d: invalid latency: %v", i, err)})
+				return
+			}
+			rule.Latency = latency
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := h.faults.SetRules(rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.GetRules(c)
+}
+
+func (h *FaultHandler) ClearRules(c *gin.Context) {
+	if err := h.faults.SetRules(nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Fault rules cleared"})
+}
@@ -1,6 +1,7 @@
 package rest
 
 import (
+	"crypto/subtle"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -56,6 +57,25 @@ func (a *AuthHandler) AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// AdminTokenMiddleware guards operator endpoints. Only requests whose bearer
+// token is the configured admin token get through; user tokens do not.
+func AdminTokenMiddleware(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := getTokenFromRequest(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, NewUnauthorizedError("token is missing or invalid", err))
+			return
+		}
+
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, NewUnauthorizedError("wrong admin token", nil))
+			return
+		}
+
+		c.Next()
+	}
+}
+
 func GetUsernameFromContext(c *gin.Context) (string, error) {
 	username, exists := c.Get(ctxUsernameKey)
 	if !exists {
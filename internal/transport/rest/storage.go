@@ -1,12 +1,19 @@
 package rest
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"strunetsdrive/internal/models"
+	"strunetsdrive/internal/service"
 	"time"
 )
 
@@ -35,15 +42,29 @@ func (h *FileHandler) InjectRoutes(r *gin.Engine, middlewares ...gin.HandlerFunc
 		files.PUT("/:id", h.UpdateFile)
 		files.POST("/:id/copy", h.CopyFile)
 		files.PUT("/:id/move", h.MoveFile)
+		files.POST("/batch/move", h.BatchMoveFiles)
 		files.GET("/:id/info", h.GetFileInfo)
 	}
 
+	uploads := r.Group("/uploads").Use(middlewares...)
+	{
+		uploads.POST("", h.CreateUploadSession)
+		uploads.POST("/:id/finalize", h.FinalizeUpload)
+	}
+	// Signed upload URLs carry their own authorization.
+	r.PUT("/uploads/:id", h.ReceiveUpload)
+
 	folders := r.Group("/folders").Use(middlewares...)
 	{
 		folders.POST("", h.CreateFolder)
 		folders.GET("", h.GetFolderContent)
 		folders.GET("/:id", h.GetFolderContent)
 		folders.GET("/:id/download", h.DownloadFolder)
+		folders.PUT("/:id", h.RenameFolder)
+		folders.DELETE("/:id", h.DeleteFolder)
+		folders.PUT("/:id/move", h.MoveFolder)
+		folders.POST("/:id/copy", h.CopyFolder)
+		folders.GET("/copy-jobs/:id", h.GetCopyJob)
 		folders.GET("/hierarchy", h.GetFolderHierarchy)
 		folders.GET("/complete", h.GetCompleteHierarchy)
 	}
@@ -59,7 +80,7 @@ func (h *FileHandler) ListFiles(c *gin.Context) {
 		return
 	}
 
-	files, err := h.service.ListFiles(username)
+	files, err := h.service.ListFiles(c.Request.Context(), username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": fmt.Sprintf("Failed to list files: %v", err),
@@ -81,7 +102,7 @@ func (h *FileHandler) GetFolderContent(c *gin.Context) {
 
 	folderID := c.Param("id")
 
-	folderContent, err := h.service.GetFolderContent(folderID, username)
+	folderContent, err := h.service.GetFolderContent(c.Request.Context(), folderID, username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -111,7 +132,7 @@ func (h *FileHandler) UploadFolderStructure(c *gin.Context) {
 	defer form.RemoveAll()
 
 	if parentFolderID == "" {
-		rootFolder, err := h.service.GetRootFolder(username)
+		rootFolder, err := h.service.GetRootFolder(c.Request.Context(), username)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": "Failed to get root folder",
@@ -136,7 +157,7 @@ func (h *FileHandler) UploadFolderStructure(c *gin.Context) {
 		currentParentID := parentFolderID
 		if dir != "." {
 
-			currentParentID, err = h.createNestedFolders(username, dir, parentFolderID, folderMap)
+			currentParentID, err = h.createNestedFolders(c.Request.Context(), username, dir, parentFolderID, folderMap)
 			if err != nil {
 				uploadErrors = append(uploadErrors, fmt.Sprintf("Failed to create folder for %s: %v", relativePath, err))
 				continue
@@ -150,7 +171,7 @@ func (h *FileHandler) UploadFolderStructure(c *gin.Context) {
 		}
 		defer file.Close()
 
-		fileInfo, err := h.service.UploadFile(username, filename, file, fileHeader.Size, currentParentID)
+		fileInfo, err := h.service.UploadFile(c.Request.Context(), username, filename, file, fileHeader.Size, currentParentID)
 		if err != nil {
 			uploadErrors = append(uploadErrors, fmt.Sprintf("Failed to upload file %s: %v", relativePath, err))
 			continue
@@ -176,7 +197,7 @@ func (h *FileHandler) UploadFolderStructure(c *gin.Context) {
 	}
 }
 
-func (h *FileHandler) createNestedFolders(username, relativePath, parentFolderID string, folderMap map[string]*models.Folder) (string, error) {
+func (h *FileHandler) createNestedFolders(ctx context.Context, username, relativePath, parentFolderID string, folderMap map[string]*models.Folder) (string, error) {
 
 	if folder, exists := folderMap[relativePath]; exists {
 		return folder.ID, nil
@@ -199,7 +220,12 @@ func (h *FileHandler) createNestedFolders(username, relativePath, parentFolderID
 			continue
 		}
 
-		folder, err := h.service.CreateFolder(username, part, currentParentID)
+		folder, err := h.service.CreateFolder(ctx, username, part, currentParentID)
+		var conflict *service.NameConflictError
+		if errors.As(err, &conflict) {
+			// Uploading into an existing structure merges with it.
+			folder, err = &models.Folder{ID: conflict.ID, Name: conflict.Name}, nil
+		}
 		if err != nil {
 			return "", err
 		}
@@ -244,11 +270,81 @@ func (h *FileHandler) UploadFile(c *gin.Context) {
 
 	//username := c.GetString("username")
 
-	fileInfo, err := h.service.UploadFile(username, header.Filename, file, header.Size, folderID)
+	fileInfo, err := h.service.UploadFile(c.Request.Context(), username, header.Filename, file, header.Size, folderID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": fmt.Sprintf("Failed to upload file: %v", err),
-		})
+		c.JSON(errorStatus(err), errorBody("Failed to upload file", err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "File uploaded successfully",
+		"file":    fileInfo,
+	})
+}
+
+func (h *FileHandler) CreateUploadSession(c *gin.Context) {
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
+		return
+	}
+
+	var input struct {
+		Name     string `json:"name"`
+		Size     int64  `json:"size"`
+		FolderID string `json:"folder_id,omitempty"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Name == "" || input.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File name and a positive size are required"})
+		return
+	}
+
+	session, err := h.service.CreateUploadSession(c.Request.Context(), username, input.Name, input.Size, input.FolderID)
+	if err != nil {
+		c.JSON(errorStatus(err), errorBody("Failed to create upload session", err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         session.ID,
+		"upload_url": session.UploadURL,
+		"method":     http.MethodPut,
+		"expires_at": session.ExpiresAt,
+	})
+}
+
+func (h *FileHandler) ReceiveUpload(c *gin.Context) {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires parameter"})
+		return
+	}
+
+	err = h.service.ReceiveUpload(c.Request.Context(), c.Param("id"), expires, c.Query("signature"), c.Request.Body)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (h *FileHandler) FinalizeUpload(c *gin.Context) {
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
+		return
+	}
+
+	fileInfo, err := h.service.FinalizeUpload(c.Request.Context(), username, c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), errorBody("Failed to finalize upload", err))
 		return
 	}
 
@@ -273,7 +369,7 @@ func (h *FileHandler) DownloadSelectedFiles(c *gin.Context) {
 		return
 	}
 
-	zipReader, err := h.service.DownloadSelectedFilesAsZip(username, request.FileIDs)
+	zipReader, err := h.service.DownloadSelectedFilesAsZip(c.Request.Context(), username, request.FileIDs)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -298,7 +394,7 @@ func (h *FileHandler) DownloadAllFilesAsZip(c *gin.Context) {
 		return
 	}
 
-	zipReader, err := h.service.DownloadFilesAsZip(username)
+	zipReader, err := h.service.DownloadFilesAsZip(c.Request.Context(), username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -325,14 +421,14 @@ func (h *FileHandler) DownloadFolder(c *gin.Context) {
 
 	folderID := c.Param("id")
 
-	zipReader, err := h.service.DownloadFolderAsZip(folderID)
+	zipReader, err := h.service.DownloadFolderAsZip(c.Request.Context(), folderID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	defer zipReader.Close()
 
-	folderContent, err := h.service.GetFolderContent(folderID, username)
+	folderContent, err := h.service.GetFolderContent(c.Request.Context(), folderID, username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -365,9 +461,9 @@ func (h *FileHandler) CreateFolder(c *gin.Context) {
 		return
 	}
 
-	folder, err := h.service.CreateFolder(username, folderInput.Name, folderInput.ParentID)
+	folder, err := h.service.CreateFolder(c.Request.Context(), username, folderInput.Name, folderInput.ParentID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), errorBody("Failed to create folder", err))
 		return
 	}
 
@@ -383,9 +479,9 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 		return
 	}
 
-	readSeeker, fileInfo, err := h.service.DownloadFile(fileID)
+	readSeeker, fileInfo, err := h.service.DownloadFile(c.Request.Context(), fileID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+		c.JSON(errorStatus(err), gin.H{
 			"error": fmt.Sprintf("Failed to get file: %v", err),
 		})
 		return
@@ -396,6 +492,7 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 	c.Header("Content-Type", "application/octet-stream")
 	c.Header("Content-Length", fmt.Sprintf("%d", fileInfo.Size))
 	c.Header("Accept-Ranges", "bytes")
+	setChecksumHeaders(c, fileInfo)
 
 	http.ServeContent(c.Writer, c.Request, fileInfo.Name, time.Time{}, readSeeker)
 }
@@ -413,14 +510,159 @@ func (h *FileHandler) DeleteFile(c *gin.Context) {
 		return
 	}
 
-	if err := h.service.DeleteFile(username, fileID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := h.service.DeleteFile(c.Request.Context(), username, fileID); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
 }
 
+func (h *FileHandler) DeleteFolder(c *gin.Context) {
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
+		return
+	}
+
+	deleted, failed, err := h.service.DeleteFolder(c.Request.Context(), username, c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error":         fmt.Sprintf("Failed to delete folder: %v", err),
+			"deleted_files": deleted,
+		})
+		return
+	}
+
+	if len(failed) > 0 {
+		items := make([]gin.H, 0, len(failed))
+		for _, result := range failed {
+			items = append(items, gin.H{
+				"file_id": result.FileID,
+				"name":    result.File.Name,
+				"status":  errorStatus(result.Err),
+				"error":   result.Err.Error(),
+			})
+		}
+
+		// The folder is kept so the deletion can be retried.
+		c.JSON(http.StatusMultiStatus, gin.H{
+			"message":       "Folder partially deleted",
+			"deleted_files": deleted,
+			"failed":        items,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Folder deleted successfully",
+		"deleted_files": deleted,
+	})
+}
+
+func (h *FileHandler) MoveFolder(c *gin.Context) {
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
+		return
+	}
+
+	// Without a parent the folder is moved to the Root folder.
+	var input struct {
+		ParentID string `json:"parent_id"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	folder, err := h.service.MoveFolder(c.Request.Context(), username, c.Param("id"), input.ParentID)
+	if err != nil {
+		c.JSON(errorStatus(err), errorBody("Failed to move folder", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Folder moved successfully",
+		"folder":  folder,
+	})
+}
+
+func (h *FileHandler) CopyFolder(c *gin.Context) {
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
+		return
+	}
+
+	// Without a destination the copy goes to the Root folder.
+	var input struct {
+		FolderID string `json:"folder_id"`
+		Name     string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	job, err := h.service.CopyFolder(c.Request.Context(), username, c.Param("id"), input.FolderID, input.Name)
+	if err != nil {
+		c.JSON(errorStatus(err), errorBody("Failed to copy folder", err))
+		return
+	}
+
+	// Large trees are still being copied; the job reports the progress.
+	status := http.StatusCreated
+	if job.Status == service.CopyJobRunning {
+		status = http.StatusAccepted
+		c.Header("Location", "/folders/copy-jobs/"+job.ID)
+	}
+	c.JSON(status, copyJobResponse(job))
+}
+
+func (h *FileHandler) GetCopyJob(c *gin.Context) {
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
+		return
+	}
+
+	job, err := h.service.GetCopyJob(c.Request.Context(), username, c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, copyJobResponse(job))
+}
+
+func copyJobResponse(job *models.CopyJob) gin.H {
+	failed := make([]gin.H, 0, len(job.Failed))
+	for _, result := range job.Failed {
+		failed = append(failed, gin.H{
+			"file_id": result.FileID,
+			"name":    result.File.Name,
+			"error":   result.Err.Error(),
+		})
+	}
+
+	response := gin.H{
+		"id":          job.ID,
+		"status":      job.Status,
+		"source_id":   job.SourceID,
+		"folder_id":   job.FolderID,
+		"total":       job.Total,
+		"copied":      job.Copied,
+		"failed":      failed,
+		"created_at":  job.CreatedAt,
+		"finished_at": job.FinishedAt,
+	}
+	if job.Error != "" {
+		response["error"] = job.Error
+	}
+	return response
+}
+
 func (h *FileHandler) GetFolderHierarchy(c *gin.Context) {
 	username, err := GetUsernameFromContext(c)
 	if err != nil {
@@ -430,7 +672,7 @@ func (h *FileHandler) GetFolderHierarchy(c *gin.Context) {
 		return
 	}
 
-	hierarchy, err := h.service.GetFolderHierarchy(username)
+	hierarchy, err := h.service.GetFolderHierarchy(c.Request.Context(), username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": fmt.Sprintf("Failed to get folder hierarchy: %v", err),
@@ -450,7 +692,7 @@ func (h *FileHandler) GetCompleteHierarchy(c *gin.Context) {
 		return
 	}
 
-	hierarchy, err := h.service.GetCompleteHierarchy(username)
+	hierarchy, err := h.service.GetCompleteHierarchy(c.Request.Context(), username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": fmt.Sprintf("Failed to get complete hierarchy: %v", err),
@@ -462,167 +704,204 @@ func (h *FileHandler) GetCompleteHierarchy(c *gin.Context) {
 }
 
 func (h *FileHandler) CopyFile(c *gin.Context) {
-	//fileID := c.Param("id")
-	//if fileID == "" {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": "File ID is required",
-	//	})
-	//	return
-	//}
-	//
-	//username, err := GetUsernameFromContext(c)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{
-	//		"error": "Failed to get username",
-	//	})
-	//	return
-	//}
-	//
-	//var copyInput struct {
-	//	NewFileName string `json:"new_filename"`
-	//}
-	//if err := c.ShouldBindJSON(&copyInput); err != nil {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": "Invalid input",
-	//	})
-	//	return
-	//}
-	//
-	//// If no new filename provided, generate a default one
-	//if copyInput.NewFileName == "" {
-	//	copyInput.NewFileName = fmt.Sprintf("Copy_of_%s", fileID)
-	//}
-	//
-	//copiedFileInfo, err := h.service.CopyFile(username, fileID, copyInput.NewFileName)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{
-	//		"error": fmt.Sprintf("Failed to copy file: %v", err),
-	//	})
-	//	return
-	//}
-	//
-	//c.JSON(http.StatusCreated, gin.H{
-	//	"message": "File copied successfully",
-	//	"file":    copiedFileInfo,
-	//})
+	fileID := c.Param("id")
+	if fileID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "File ID is required",
+		})
+		return
+	}
+
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get username",
+		})
+		return
+	}
+
+	// The body is optional; without a folder the copy is placed next to the
+	// source, and without a name it is called "Copy of ...".
+	var copyInput struct {
+		FolderID    string `json:"folder_id"`
+		NewFileName string `json:"new_filename"`
+	}
+	if err := c.ShouldBindJSON(&copyInput); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid input",
+		})
+		return
+	}
+
+	copiedFileInfo, err := h.service.CopyFile(c.Request.Context(), username, fileID, copyInput.FolderID, copyInput.NewFileName)
+	if err != nil {
+		c.JSON(errorStatus(err), errorBody("Failed to copy file", err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "File copied successfully",
+		"file":    copiedFileInfo,
+	})
 }
 
 func (h *FileHandler) GetFileInfo(c *gin.Context) {
-	//fileID := c.Param("id")
-	//if fileID == "" {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": "File ID is required",
-	//	})
-	//	return
-	//}
-	//
-	//username, err := GetUsernameFromContext(c)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{
-	//		"error": "Failed to get username",
-	//	})
-	//	return
-	//}
-	//
-	//fileInfo, err := h.service.GetFileInfo(username, fileID)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{
-	//		"error": fmt.Sprintf("Failed to retrieve file info: %v", err),
-	//	})
-	//	return
-	//}
-	//
-	//c.JSON(http.StatusOK, fileInfo)
+	fileID := c.Param("id")
+	if fileID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "File ID is required",
+		})
+		return
+	}
+
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get username",
+		})
+		return
+	}
+
+	fileInfo, err := h.service.GetFileInfo(c.Request.Context(), username, fileID)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{
+			"error": fmt.Sprintf("Failed to retrieve file info: %v", err),
+		})
+		return
+	}
+
+	setChecksumHeaders(c, fileInfo)
+	c.JSON(http.StatusOK, fileInfo)
+}
+
+// setChecksumHeaders exposes the stored digests as a strong ETag and an
+// RFC 3230 Digest header.
+func setChecksumHeaders(c *gin.Context, file *models.File) {
+	if file.Checksum == "" {
+		return
+	}
+
+	c.Header("ETag", fmt.Sprintf("%q", file.Checksum))
+
+	digests := []string{"sha-256=" + hexToBase64(file.Checksum)}
+	if file.ChecksumMD5 != "" {
+		digests = append(digests, "md5="+hexToBase64(file.ChecksumMD5))
+	}
+	c.Header("Digest", strings.Join(digests, ","))
+}
+
+func hexToBase64(s string) string {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(raw)
 }
 
 func (h *FileHandler) MoveFile(c *gin.Context) {
-	//fileID := c.Param("id")
-	//if fileID == "" {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": "File ID is required",
-	//	})
-	//	return
-	//}
-	//
-	//username, err := GetUsernameFromContext(c)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{
-	//		"error": "Failed to get username",
-	//	})
-	//	return
-	//}
-	//
-	//var moveInput struct {
-	//	DestinationPath string `json:"destination_path"`
-	//}
-	//if err := c.ShouldBindJSON(&moveInput); err != nil {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": "Invalid input",
-	//	})
-	//	return
-	//}
-	//
-	//if moveInput.DestinationPath == "" {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": "Destination path is required",
-	//	})
-	//	return
-	//}
-	//
-	//movedFileInfo, err := h.service.MoveFile(username, fileID, moveInput.DestinationPath)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{
-	//		"error": fmt.Sprintf("Failed to move file: %v", err),
-	//	})
-	//	return
-	//}
-	//
-	//c.JSON(http.StatusOK, gin.H{
-	//	"message": "File moved successfully",
-	//	"file":    movedFileInfo,
-	//})
+	fileID := c.Param("id")
+	if fileID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "File ID is required",
+		})
+		return
+	}
+
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get username",
+		})
+		return
+	}
+
+	// Without a folder the file is moved to the Root folder.
+	var moveInput struct {
+		FolderID string `json:"folder_id"`
+	}
+	if err := c.ShouldBindJSON(&moveInput); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid input",
+		})
+		return
+	}
+
+	movedFileInfo, err := h.service.MoveFile(c.Request.Context(), username, fileID, moveInput.FolderID)
+	if err != nil {
+		c.JSON(errorStatus(err), errorBody("Failed to move file", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "File moved successfully",
+		"file":    movedFileInfo,
+	})
 }
 
 func (h *FileHandler) UpdateFile(c *gin.Context) {
-	//fileID := c.Param("id")
-	//if fileID == "" {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": "File ID is required",
-	//	})
-	//	return
-	//}
-	//
-	//username, err := GetUsernameFromContext(c)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{
-	//		"error": "Failed to get username",
-	//	})
-	//	return
-	//}
-	//
-	//var updateInput struct {
-	//	Name string   `json:"name"`
-	//	Tags []string `json:"tags"`
-	//}
-	//if err := c.ShouldBindJSON(&updateInput); err != nil {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": "Invalid input",
-	//	})
-	//	return
-	//}
-	//
-	//updatedFileInfo, err := h.service.UpdateFileMetadata(username, fileID, updateInput.Name, updateInput.Tags)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{
-	//		"error": fmt.Sprintf("Failed to update file: %v", err),
-	//	})
-	//	return
-	//}
-	//
-	//c.JSON(http.StatusOK, gin.H{
-	//	"message": "File metadata updated successfully",
-	//	"file":    updatedFileInfo,
-	//})
+	fileID := c.Param("id")
+	if fileID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "File ID is required",
+		})
+		return
+	}
+
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get username",
+		})
+		return
+	}
+
+	var updateInput struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&updateInput); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid input",
+		})
+		return
+	}
+
+	updatedFileInfo, err := h.service.RenameFile(c.Request.Context(), username, fileID, updateInput.Name)
+	if err != nil {
+		c.JSON(errorStatus(err), errorBody("Failed to update file", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "File renamed successfully",
+		"file":    updatedFileInfo,
+	})
+}
+
+func (h *FileHandler) RenameFolder(c *gin.Context) {
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
+		return
+	}
+
+	var input struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	folder, err := h.service.RenameFolder(c.Request.Context(), username, c.Param("id"), input.Name)
+	if err != nil {
+		c.JSON(errorStatus(err), errorBody("Failed to rename folder", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Folder renamed successfully",
+		"folder":  folder,
+	})
 }
 
 //fileId := c.Param("id")
@@ -703,28 +982,48 @@ func (h *FileHandler) GetRecentFiles(c *gin.Context) {
 }
 
 func (h *FileHandler) BatchMoveFiles(c *gin.Context) {
-	//username, err := GetUsernameFromContext(c)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
-	//	return
-	//}
-	//
-	//var input struct {
-	//	FileIDs  []string `json:"file_ids"`
-	//	TargetID string   `json:"target_folder_id"`
-	//}
-	//
-	//if err := c.ShouldBindJSON(&input); err != nil {
-	//	c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
-	//	return
-	//}
-	//
-	//if err := h.service.BatchMoveFiles(username, input.FileIDs, input.TargetID); err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-	//	return
-	//}
-	//
-	//c.JSON(http.StatusOK, gin.H{"message": "Files moved successfully"})
+	username, err := GetUsernameFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get username"})
+		return
+	}
+
+	var input struct {
+		FileIDs  []string `json:"file_ids"`
+		TargetID string   `json:"target_folder_id"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil || len(input.FileIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	results, err := h.service.BatchMoveFiles(c.Request.Context(), username, input.FileIDs, input.TargetID)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": fmt.Sprintf("Failed to move files: %v", err)})
+		return
+	}
+
+	status := http.StatusOK
+	items := make([]gin.H, 0, len(results))
+	for _, result := range results {
+		if result.Err != nil {
+			status = http.StatusMultiStatus
+			items = append(items, gin.H{
+				"file_id": result.FileID,
+				"status":  errorStatus(result.Err),
+				"error":   result.Err.Error(),
+			})
+			continue
+		}
+		items = append(items, gin.H{
+			"file_id": result.FileID,
+			"status":  http.StatusOK,
+			"file":    result.File,
+		})
+	}
+
+	c.JSON(status, gin.H{"results": items})
 }
 
 func (h *FileHandler) UpdateFileTags(c *gin.Context) {
@@ -824,7 +1123,6 @@ func (h *FileHandler) GetUserActivity(c *gin.Context) {
 //
 //// Расширенные операции с файлами
 //files.POST("/batch/delete", h.BatchDeleteFiles)
-//files.POST("/batch/move", h.BatchMoveFiles)
 //files.POST("/batch/copy", h.BatchCopyFiles)
 //files.POST("/:id/compress", h.CompressFiles)
 //files.POST("/decompress/:id", h.DecompressArchive)
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS update_blob_ref_count_trigger ON files;
+DROP FUNCTION IF EXISTS update_blob_ref_count();
+ALTER TABLE files DROP COLUMN IF EXISTS blob_hash;
+DROP TABLE IF EXISTS blobs;
\ No newline at end of file
@@ -0,0 +1,33 @@
+CREATE TABLE blobs (
+                       hash VARCHAR(64) PRIMARY KEY,
+                       path VARCHAR(255) NOT NULL,
+                       size BIGINT NOT NULL,
+                       ref_count INTEGER NOT NULL DEFAULT 0,
+                       created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE files ADD COLUMN blob_hash VARCHAR(64) REFERENCES blobs(hash);
+
+CREATE INDEX idx_files_blob_hash ON files(blob_hash);
+
+CREATE OR REPLACE FUNCTION update_blob_ref_count()
+RETURNS TRIGGER AS $$
+BEGIN
+IF TG_OP <> 'INSERT' THEN
+    IF OLD.blob_hash IS NOT NULL THEN
+        UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = OLD.blob_hash;
+    END IF;
+END IF;
+IF TG_OP <> 'DELETE' THEN
+    IF NEW.blob_hash IS NOT NULL THEN
+        UPDATE blobs SET ref_count = ref_count + 1 WHERE hash = NEW.blob_hash;
+    END IF;
+END IF;
+RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER update_blob_ref_count_trigger
+    AFTER INSERT OR DELETE OR UPDATE OF blob_hash ON files
+    FOR EACH ROW
+    EXECUTE FUNCTION update_blob_ref_count();
@@ -0,0 +1,2 @@
+ALTER TABLE files DROP COLUMN IF EXISTS checksum_md5;
+ALTER TABLE files DROP COLUMN IF EXISTS checksum;
\ No newline at end of file
@@ -0,0 +1,4 @@
+ALTER TABLE files ADD COLUMN checksum VARCHAR(64);
+ALTER TABLE files ADD COLUMN checksum_md5 VARCHAR(32);
+
+UPDATE files SET checksum = blob_hash WHERE blob_hash IS NOT NULL;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS storage_migrations;
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE storage_migrations (
+    path VARCHAR(255) PRIMARY KEY,
+    new_path VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    migrated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_files_tier_last_accessed;
+
+ALTER TABLE files DROP COLUMN IF EXISTS last_accessed_at;
+ALTER TABLE files DROP COLUMN IF EXISTS tier;
\ No newline at end of file
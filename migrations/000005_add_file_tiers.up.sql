@@ -0,0 +1,4 @@
+ALTER TABLE files ADD COLUMN tier VARCHAR(8) NOT NULL DEFAULT 'hot';
+ALTER TABLE files ADD COLUMN last_accessed_at TIMESTAMP;
+
+CREATE INDEX idx_files_tier_last_accessed ON files (tier, last_accessed_at);
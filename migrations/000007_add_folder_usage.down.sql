@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS update_folder_usage_trigger ON files;
+DROP FUNCTION IF EXISTS update_folder_usage();
+DROP FUNCTION IF EXISTS add_folder_usage(VARCHAR, BIGINT, BIGINT);
+
+ALTER TABLE folders DROP COLUMN IF EXISTS file_count;
+ALTER TABLE folders DROP COLUMN IF EXISTS size;
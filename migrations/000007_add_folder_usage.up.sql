@@ -0,0 +1,47 @@
+-- Every folder counts the files in its whole subtree, so a user's Root
+-- folder holds that user's totals.
+ALTER TABLE folders ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE folders ADD COLUMN file_count BIGINT NOT NULL DEFAULT 0;
+
+UPDATE folders fo
+SET size = usage.size, file_count = usage.file_count
+FROM (
+    SELECT ancestor.id, SUM(fi.size) AS size, COUNT(*) AS file_count
+    FROM files fi
+    JOIN folders f ON f.id = fi.folder_id
+    CROSS JOIN LATERAL unnest(f.path_array || f.id) AS ancestor(id)
+    WHERE fi.is_dir IS NOT TRUE
+    GROUP BY ancestor.id
+) usage
+WHERE fo.id = usage.id;
+
+CREATE OR REPLACE FUNCTION add_folder_usage(p_folder_id VARCHAR, p_size BIGINT, p_count BIGINT)
+RETURNS VOID AS $$
+BEGIN
+UPDATE folders
+SET size = size + p_size, file_count = file_count + p_count
+WHERE id IN (
+    SELECT p_folder_id
+    UNION
+    SELECT unnest(path_array) FROM folders WHERE id = p_folder_id
+);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION update_folder_usage()
+RETURNS TRIGGER AS $$
+BEGIN
+IF TG_OP <> 'INSERT' AND OLD.is_dir IS NOT TRUE THEN
+    PERFORM add_folder_usage(OLD.folder_id, -OLD.size, -1);
+END IF;
+IF TG_OP <> 'DELETE' AND NEW.is_dir IS NOT TRUE THEN
+    PERFORM add_folder_usage(NEW.folder_id, NEW.size, 1);
+END IF;
+RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER update_folder_usage_trigger
+    AFTER INSERT OR DELETE OR UPDATE OF folder_id, size, is_dir ON files
+    FOR EACH ROW
+    EXECUTE FUNCTION update_folder_usage();
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_folders_parent_id_name;
+DROP INDEX IF EXISTS idx_files_folder_id_name;
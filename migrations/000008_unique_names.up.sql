@@ -0,0 +1,22 @@
+-- Names are unique per parent, ignoring case. Existing duplicates keep their
+-- oldest entry as is; the others get their id appended.
+UPDATE files f
+SET name = LEFT(f.name, 200) || ' (' || f.id || ')'
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY folder_id, LOWER(name) ORDER BY uploaded_at, id) AS n
+    FROM files
+    WHERE is_dir IS NOT TRUE
+) dup
+WHERE f.id = dup.id AND dup.n > 1;
+
+UPDATE folders f
+SET name = LEFT(f.name, 200) || ' (' || f.id || ')'
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY parent_id, LOWER(name) ORDER BY created_at, id) AS n
+    FROM folders
+    WHERE parent_id IS NOT NULL
+) dup
+WHERE f.id = dup.id AND dup.n > 1;
+
+CREATE UNIQUE INDEX idx_files_folder_id_name ON files(folder_id, LOWER(name)) WHERE is_dir IS NOT TRUE;
+CREATE UNIQUE INDEX idx_folders_parent_id_name ON folders(parent_id, LOWER(name));
@@ -0,0 +1,423 @@
+package compressed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"strunetsdrive/pkg/filestore"
+	"time"
+)
+
+// IndexSuffix marks the sidecar object holding a compressed object's seek
+// index. Its presence is what flags an object as compressed; objects without
+// one, or whose stored size does not match it, are stored as is.
+const IndexSuffix = ".zst"
+
+// PendingIndexSuffix marks the index of compressed data that is being
+// written. It only replaces the IndexSuffix sidecar once the data has been
+// committed; until then reads pick whichever index fits the stored data.
+const PendingIndexSuffix = ".zst.pending"
+
+type index struct {
+	Codec     string `json:"codec"`
+	FrameSize int    `json:"frame_size"`
+	Size      int64  `json:"size"`
+	// Frames holds the compressed length of every frame in order.
+	Frames []int64 `json:"frames"`
+}
+
+// storedSize is the size of the compressed data the index describes.
+func (idx *index) storedSize() int64 {
+	var size int64
+	for _, length := range idx.Frames {
+		size += length
+	}
+	return size
+}
+
+// Store compresses objects with zstd before handing them to inner. Objects
+// are split into independently compressed frames so that readers can seek
+// without decompressing everything before the target offset. Small objects
+// and content that is already compressed are stored unchanged.
+type Store struct {
+	inner   filestore.Store
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewStore wraps inner, compressing at the given zstd level (1-22).
+func NewStore(inner filestore.Store, level int) (*Store, error) {
+	// EncodeAll runs on as many frames at once as the encoder's concurrency,
+	// which defaults to GOMAXPROCS, so concurrent uploads do not queue.
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+
+	return &Store{inner: inner, encoder: encoder, decoder: decoder}, nil
+}
+
+// incompressibleTypes are MIME types whose content is already compressed.
+// Types ending in "/" match every subtype.
+var incompressibleTypes = []string{
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/zstd",
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"video/",
+	"audio/",
+}
+
+// incompressible reports whether an object is not worth compressing, judged
+// by the key's extension and by sniffing its first bytes; content-addressed
+// keys carry no extension.
+func incompressible(path string, head []byte) bool {
+	for _, contentType := range []string{
+		mime.TypeByExtension(filepath.Ext(path)),
+		http.DetectContentType(head),
+	} {
+		contentType, _, _ = strings.Cut(contentType, ";")
+		for _, t := range incompressibleTypes {
+			if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Store) Create(ctx context.Context, path string) (filestore.Writer, error) {
+	if isIndex(path) {
+		return nil, fmt.Errorf("%w: %q uses a reserved index suffix", filestore.ErrInvalidPath, path)
+	}
+
+	w, err := s.inner.Create(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{
+		ctx:     ctx,
+		w:       w,
+		path:    path,
+		encoder: s.encoder,
+		buf:     make([]byte, 0, frameSize),
+		// The index is staged before the data is committed and replaces the
+		// index of a previous version only afterwards, so committed data
+		// always has an index that fits.
+		stageIndex: func(idx *index) error {
+			return s.writeIndex(ctx, path+PendingIndexSuffix, idx)
+		},
+		commitIndex: func() error {
+			return s.commitIndex(ctx, path)
+		},
+		dropIndex: func() {
+			_ = s.inner.Delete(context.WithoutCancel(ctx), path+PendingIndexSuffix)
+		},
+		// A previous version of the object may have been compressed.
+		commitRaw: func() error {
+			if err := s.inner.Delete(ctx, path+IndexSuffix); err != nil {
+				return err
+			}
+			return s.inner.Delete(ctx, path+PendingIndexSuffix)
+		},
+	}, nil
+}
+
+func isIndex(path string) bool {
+	return strings.HasSuffix(path, IndexSuffix) || strings.HasSuffix(path, PendingIndexSuffix)
+}
+
+// commitIndex replaces the index of path with its pending one.
+func (s *Store) commitIndex(ctx context.Context, path string) error {
+	if err := s.inner.MoveObject(ctx, path+PendingIndexSuffix, path+IndexSuffix); err != nil {
+		return fmt.Errorf("failed to commit compression index: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	r, err := s.inner.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = r.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to determine object size: %w", err)
+	}
+
+	idx, err := s.findIndex(ctx, path, size)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if idx == nil {
+		return r, nil
+	}
+
+	return newReader(r, s.decoder, idx), nil
+}
+
+// findIndex returns the index that fits the data of path, size bytes as
+// stored, or nil when the data is stored as is. The current and the pending
+// index are told apart by size, as either may be stale while a write commits.
+func (s *Store) findIndex(ctx context.Context, path string, size int64) (*index, error) {
+	for _, indexPath := range []string{path + IndexSuffix, path + PendingIndexSuffix} {
+		idx, err := s.readIndex(ctx, indexPath)
+		if errors.Is(err, filestore.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if idx.storedSize() == size {
+			return idx, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetPresignedURL refuses compressed objects since the URL would hand out
+// compressed frames.
+func (s *Store) GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	exists, err := s.inner.ObjectExists(ctx, path+IndexSuffix)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("presigned urls for compressed objects: %w", filestore.ErrNotSupported)
+	}
+	return s.inner.GetPresignedURL(ctx, path, expires)
+}
+
+// GetPresignedPutURL lets the client store the object uncompressed. It is
+// refused while an index exists, which would be taken for the new object's.
+func (s *Store) GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	exists, err := s.inner.ObjectExists(ctx, path+IndexSuffix)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("presigned upload urls over compressed objects: %w", filestore.ErrNotSupported)
+	}
+	return s.inner.GetPresignedPutURL(ctx, path, expires)
+}
+
+func (s *Store) Delete(ctx context.Context, path string) error {
+	if err := s.inner.Delete(ctx, path); err != nil {
+		return err
+	}
+	if err := s.inner.Delete(ctx, path+IndexSuffix); err != nil {
+		return err
+	}
+	return s.inner.Delete(ctx, path+PendingIndexSuffix)
+}
+
+// MoveObject moves the object together with its index. The index is staged
+// at the destination and committed once the data has moved, and the source
+// index is removed last, so neither path holds compressed data without it.
+func (s *Store) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	compressed, err := s.inner.ObjectExists(ctx, sourcePath+IndexSuffix)
+	if err != nil {
+		return err
+	}
+
+	if !compressed {
+		if err := s.inner.MoveObject(ctx, sourcePath, destPath); err != nil {
+			return err
+		}
+		return s.inner.Delete(ctx, destPath+IndexSuffix)
+	}
+
+	if err := s.inner.CopyObject(ctx, sourcePath+IndexSuffix, destPath+PendingIndexSuffix); err != nil {
+		return err
+	}
+
+	if err := s.inner.MoveObject(ctx, sourcePath, destPath); err != nil {
+		_ = s.inner.Delete(context.WithoutCancel(ctx), destPath+PendingIndexSuffix)
+		return err
+	}
+
+	if err := s.commitIndex(ctx, destPath); err != nil {
+		return err
+	}
+	return s.inner.Delete(ctx, sourcePath+IndexSuffix)
+}
+
+// CopyObject copies the object and its index. When the source was stored
+// uncompressed, a stale index at the destination is removed.
+func (s *Store) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	compressed, err := s.inner.ObjectExists(ctx, sourcePath+IndexSuffix)
+	if err != nil {
+		return err
+	}
+
+	if !compressed {
+		if err := s.inner.CopyObject(ctx, sourcePath, destPath); err != nil {
+			return err
+		}
+		return s.inner.Delete(ctx, destPath+IndexSuffix)
+	}
+
+	if err := s.inner.CopyObject(ctx, sourcePath+IndexSuffix, destPath+PendingIndexSuffix); err != nil {
+		return err
+	}
+
+	if err := s.inner.CopyObject(ctx, sourcePath, destPath); err != nil {
+		_ = s.inner.Delete(context.WithoutCancel(ctx), destPath+PendingIndexSuffix)
+		return err
+	}
+
+	return s.commitIndex(ctx, destPath)
+}
+
+// ListObjects hides index sidecars and reports uncompressed sizes, which
+// takes one extra read per compressed object.
+func (s *Store) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	objects, err := s.inner.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed := make(map[string]bool)
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Path, IndexSuffix) {
+			compressed[strings.TrimSuffix(obj.Path, IndexSuffix)] = true
+		}
+	}
+
+	visible := objects[:0]
+	for _, obj := range objects {
+		if isIndex(obj.Path) {
+			continue
+		}
+		if compressed[obj.Path] {
+			idx, err := s.readIndex(ctx, obj.Path+IndexSuffix)
+			if err != nil {
+				return nil, err
+			}
+			obj.Size = idx.Size
+		}
+		visible = append(visible, obj)
+	}
+
+	return visible, nil
+}
+
+func (s *Store) GetObjectInfo(ctx context.Context, path string) (*filestore.ObjectInfo, error) {
+	info, err := s.inner.GetObjectInfo(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := s.findIndex(ctx, path, info.Size)
+	if err != nil {
+		return nil, err
+	}
+	if idx != nil {
+		info.Size = idx.Size
+	}
+	return info, nil
+}
+
+func (s *Store) CreateDirectory(ctx context.Context, path string) error {
+	return s.inner.CreateDirectory(ctx, path)
+}
+
+func (s *Store) ObjectExists(ctx context.Context, path string) (bool, error) {
+	return s.inner.ObjectExists(ctx, path)
+}
+
+func (s *Store) DeleteDirectory(ctx context.Context, path string) error {
+	return s.inner.DeleteDirectory(ctx, path)
+}
+
+func (s *Store) SafeDeleteDirectory(ctx context.Context, path string) error {
+	return s.inner.SafeDeleteDirectory(ctx, path)
+}
+
+// GetDirectorySize walks the directory so that it can report uncompressed
+// sizes and leave out index sidecars.
+func (s *Store) GetDirectorySize(ctx context.Context, path string) (int64, error) {
+	if !strings.HasSuffix(path, "/") {
+		path = path + "/"
+	}
+
+	var totalSize int64
+	err := filestore.Walk(ctx, s, path, func(obj filestore.ObjectInfo) error {
+		totalSize += obj.Size
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return totalSize, nil
+}
+
+func (s *Store) DeleteDirectoryParallel(ctx context.Context, path string) error {
+	return s.inner.DeleteDirectoryParallel(ctx, path)
+}
+
+func (s *Store) readIndex(ctx context.Context, indexPath string) (*index, error) {
+	r, err := s.inner.Open(ctx, indexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var idx index
+	if err := json.NewDecoder(r).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("failed to read compression index: %w", err)
+	}
+
+	if idx.Codec != codecZstd || idx.FrameSize != frameSize {
+		return nil, fmt.Errorf("unsupported compression %s with %d byte frames", idx.Codec, idx.FrameSize)
+	}
+	return &idx, nil
+}
+
+func (s *Store) writeIndex(ctx context.Context, indexPath string, idx *index) error {
+	w, err := s.inner.Create(ctx, indexPath)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(idx); err != nil {
+		w.Abort()
+		return fmt.Errorf("failed to write compression index: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write compression index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package compressed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strunetsdrive/pkg/filestore"
+	"sync"
+)
+
+const (
+	codecZstd = "zstd"
+
+	// frameSize is the amount of uncompressed data per zstd frame, and so the
+	// most a seek has to decompress to reach an offset.
+	frameSize = 1 << 20
+
+	// minSize is how much of an object is buffered before deciding whether
+	// to compress it; smaller objects are never compressed.
+	minSize = 4 << 10
+)
+
+type mode int
+
+const (
+	modeUndecided mode = iota
+	modeRaw
+	modeCompressed
+)
+
+type writer struct {
+	ctx         context.Context
+	w           filestore.Writer
+	path        string
+	encoder     *zstd.Encoder
+	buf         []byte
+	mode        mode
+	idx         index
+	stageIndex  func(idx *index) error
+	commitIndex func() error
+	dropIndex   func()
+	commitRaw   func() error
+	mu          sync.Mutex
+	closed      bool
+	err         error
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, errors.New("write to closed object")
+	}
+
+	if w.mode == modeRaw {
+		return w.w.Write(p)
+	}
+
+	for len(p) > 0 {
+		if len(w.buf) == frameSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(w.buf[len(w.buf):frameSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+
+		if w.mode == modeUndecided && len(w.buf) >= minSize {
+			if err := w.decide(); err != nil {
+				return n, err
+			}
+			if w.mode == modeRaw {
+				m, err := w.w.Write(p)
+				return n + m, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// decide picks raw or compressed storage once enough of the object has been
+// seen to sniff its type.
+func (w *writer) decide() error {
+	if incompressible(w.path, w.buf) {
+		w.mode = modeRaw
+		return w.writeRaw()
+	}
+
+	w.mode = modeCompressed
+	w.idx = index{Codec: codecZstd, FrameSize: frameSize}
+	return nil
+}
+
+func (w *writer) writeRaw() error {
+	if _, err := w.w.Write(w.buf); err != nil {
+		w.err = err
+		return err
+	}
+	w.buf = nil
+	return nil
+}
+
+func (w *writer) flush() error {
+	frame := w.encoder.EncodeAll(w.buf, nil)
+	if _, err := w.w.Write(frame); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.idx.Frames = append(w.idx.Frames, int64(len(frame)))
+	w.idx.Size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	// A cancelled write must not touch the index of a previous version.
+	if err := w.ctx.Err(); err != nil && w.err == nil {
+		w.err = err
+		w.w.Abort()
+		return err
+	}
+
+	if w.err == nil && w.mode == modeUndecided {
+		w.mode = modeRaw
+		w.err = w.writeRaw()
+	}
+
+	if w.err == nil && w.mode == modeCompressed {
+		if len(w.buf) > 0 {
+			w.err = w.flush()
+		}
+		if w.err == nil {
+			w.err = w.stageIndex(&w.idx)
+		}
+	}
+
+	if w.err != nil {
+		w.w.Abort()
+		if w.mode == modeCompressed {
+			w.dropIndex()
+		}
+		return w.err
+	}
+
+	if err := w.w.Close(); err != nil {
+		w.err = err
+		if w.mode == modeCompressed {
+			w.dropIndex()
+		}
+		return err
+	}
+
+	// Until the index catches up with the committed data, reads tell by the
+	// stored size which index, if any, fits.
+	if w.mode == modeRaw {
+		w.err = w.commitRaw()
+	} else {
+		w.err = w.commitIndex()
+	}
+	return w.err
+}
+
+func (w *writer) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.w.Abort()
+}
+
+type reader struct {
+	r       io.ReadSeekCloser
+	decoder *zstd.Decoder
+	idx     *index
+	// offsets holds the stored offset of every frame.
+	offsets    []int64
+	pos        int64
+	frame      []byte
+	frameIndex int64
+	mu         sync.Mutex
+}
+
+func newReader(r io.ReadSeekCloser, decoder *zstd.Decoder, idx *index) *reader {
+	offsets := make([]int64, len(idx.Frames))
+	var offset int64
+	for i, length := range idx.Frames {
+		offsets[i] = offset
+		offset += length
+	}
+
+	return &reader{
+		r:          r,
+		decoder:    decoder,
+		idx:        idx,
+		offsets:    offsets,
+		frameIndex: -1,
+	}
+}
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pos >= r.idx.Size {
+		return 0, io.EOF
+	}
+
+	index := r.pos / frameSize
+	if index != r.frameIndex {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	offset := r.pos - index*frameSize
+	if offset >= int64(len(r.frame)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n = copy(p, r.frame[offset:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *reader) load(index int64) error {
+	if index >= int64(len(r.offsets)) {
+		return fmt.Errorf("frame %d is out of range", index)
+	}
+
+	if _, err := r.r.Seek(r.offsets[index], io.SeekStart); err != nil {
+		return err
+	}
+
+	compressed := make([]byte, r.idx.Frames[index])
+	if _, err := io.ReadFull(r.r, compressed); err != nil {
+		return fmt.Errorf("failed to read frame %d: %w", index, err)
+	}
+
+	frame, err := r.decoder.DecodeAll(compressed, r.frame[:0])
+	if err != nil {
+		return fmt.Errorf("failed to decompress frame %d: %w", index, err)
+	}
+
+	r.frame = frame
+	r.frameIndex = index
+	return nil
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.idx.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *reader) Close() error {
+	return r.r.Close()
+}
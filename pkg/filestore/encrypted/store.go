@@ -0,0 +1,551 @@
+package encrypted
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"strunetsdrive/pkg/filestore"
+	"time"
+)
+
+// KeySuffix marks the sidecar object holding an object's wrapped data key.
+// Keeping the data key outside the object lets RotateKeys re-wrap it without
+// rewriting the data, which object stores cannot patch in place.
+const KeySuffix = ".dek"
+
+// PendingKeySuffix marks the data key of data that is being written. It only
+// replaces the KeySuffix sidecar once the data has been committed, and reads
+// fall back to it while the current key does not fit the data.
+const PendingKeySuffix = ".dek.pending"
+
+// ErrNoDataKey is returned when reading an object without a data key from a
+// store that does not allow plaintext objects.
+var ErrNoDataKey = errors.New("object has no data key")
+
+type dataKey struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	ChunkSize  int    `json:"chunk_size"`
+}
+
+// Store encrypts object contents with a random per-object data key, which is
+// in turn wrapped by a master key. Objects written before encryption was
+// enabled have no data key; they are only passed through unchanged when
+// plaintext objects are allowed.
+type Store struct {
+	inner          filestore.Store
+	masterKeys     map[string]cipher.AEAD
+	currentKeyID   string
+	allowPlaintext bool
+}
+
+// NewStore wraps inner. keys maps master key IDs to 32 byte AES-256 keys;
+// currentKeyID selects the one used for new objects and rotation.
+// allowPlaintext makes objects without a data key readable as they are,
+// otherwise reading them fails with ErrNoDataKey.
+func NewStore(inner filestore.Store, keys map[string][]byte, currentKeyID string, allowPlaintext bool) (*Store, error) {
+	masterKeys := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %q: %w", id, err)
+		}
+		masterKeys[id] = aead
+	}
+
+	if _, ok := masterKeys[currentKeyID]; !ok {
+		return nil, fmt.Errorf("master key %q is not configured", currentKeyID)
+	}
+
+	return &Store{
+		inner:          inner,
+		masterKeys:     masterKeys,
+		currentKeyID:   currentKeyID,
+		allowPlaintext: allowPlaintext,
+	}, nil
+}
+
+// ParseKeys decodes base64 encoded master keys as they appear in the config.
+func ParseKeys(encoded map[string]string) (map[string][]byte, error) {
+	keys := make(map[string][]byte, len(encoded))
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode master key %q: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *Store) Create(ctx context.Context, path string) (filestore.Writer, error) {
+	if isKey(path) {
+		return nil, fmt.Errorf("%w: %q uses a reserved data key suffix", filestore.ErrInvalidPath, path)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := s.wrap(s.currentKeyID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := s.inner.Create(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	dk := &dataKey{KeyID: s.currentKeyID, WrappedKey: wrapped, ChunkSize: chunkSize}
+	return &writer{
+		ctx:  ctx,
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, chunkSize),
+		// The new key is staged before the data is committed and only
+		// replaces the key of a previous version afterwards, so committed
+		// data always has a readable key.
+		stageKey: func() error {
+			return s.writeDataKey(ctx, path+PendingKeySuffix, dk)
+		},
+		commitKey: func() error {
+			return s.commitKey(ctx, path)
+		},
+		dropKey: func() {
+			// Cleanup has to run even when ctx was cancelled.
+			_ = s.inner.Delete(context.WithoutCancel(ctx), path+PendingKeySuffix)
+		},
+	}, nil
+}
+
+func isKey(path string) bool {
+	return strings.HasSuffix(path, KeySuffix) || strings.HasSuffix(path, PendingKeySuffix)
+}
+
+// commitKey replaces the data key of path with its pending one.
+func (s *Store) commitKey(ctx context.Context, path string) error {
+	if err := s.inner.MoveObject(ctx, path+PendingKeySuffix, path+KeySuffix); err != nil {
+		return fmt.Errorf("failed to commit data key: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	r, err := s.inner.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := s.decrypt(ctx, path, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// decrypt returns a reader decrypting r, the data of path. The pending data
+// key is tried when the current one is missing or does not fit, which is the
+// case while a write has committed its data but not yet its key.
+func (s *Store) decrypt(ctx context.Context, path string, r io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	var found bool
+	var lastErr error
+	for _, keyPath := range []string{path + KeySuffix, path + PendingKeySuffix} {
+		dk, err := s.readDataKey(ctx, keyPath)
+		if errors.Is(err, filestore.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+
+		aead, err := s.unwrap(dk)
+		if err != nil {
+			return nil, err
+		}
+
+		reader, err := newReader(r, aead)
+		if err != nil {
+			return nil, err
+		}
+
+		// Every encrypted object has at least one chunk; a wrong key fails
+		// to open the first.
+		if lastErr = reader.load(0); lastErr == nil {
+			return reader, nil
+		}
+	}
+
+	if !found {
+		if s.allowPlaintext {
+			return r, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNoDataKey, path)
+	}
+	return nil, lastErr
+}
+
+// GetPresignedURL refuses encrypted objects since the URL would hand out
+// ciphertext, and every object unless plaintext objects are allowed.
+func (s *Store) GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	if !s.allowPlaintext {
+		return "", fmt.Errorf("presigned urls with encryption: %w", filestore.ErrNotSupported)
+	}
+
+	exists, err := s.inner.ObjectExists(ctx, path+KeySuffix)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("presigned urls for encrypted objects: %w", filestore.ErrNotSupported)
+	}
+	return s.inner.GetPresignedURL(ctx, path, expires)
+}
+
+// GetPresignedPutURL is never supported: content uploaded through the URL
+// would be stored unencrypted.
+func (s *Store) GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("presigned upload urls with encryption: %w", filestore.ErrNotSupported)
+}
+
+func (s *Store) Delete(ctx context.Context, path string) error {
+	if err := s.inner.Delete(ctx, path); err != nil {
+		return err
+	}
+	if err := s.inner.Delete(ctx, path+KeySuffix); err != nil {
+		return err
+	}
+	return s.inner.Delete(ctx, path+PendingKeySuffix)
+}
+
+// MoveObject moves the object together with its data key. The key is staged
+// at the destination and committed once the data has moved, and the source
+// key is removed last, so neither path holds data without its key.
+func (s *Store) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	encrypted, err := s.inner.ObjectExists(ctx, sourcePath+KeySuffix)
+	if err != nil {
+		return err
+	}
+
+	if !encrypted {
+		if err := s.inner.MoveObject(ctx, sourcePath, destPath); err != nil {
+			return err
+		}
+		return s.inner.Delete(ctx, destPath+KeySuffix)
+	}
+
+	if err := s.inner.CopyObject(ctx, sourcePath+KeySuffix, destPath+PendingKeySuffix); err != nil {
+		return err
+	}
+
+	if err := s.inner.MoveObject(ctx, sourcePath, destPath); err != nil {
+		_ = s.inner.Delete(context.WithoutCancel(ctx), destPath+PendingKeySuffix)
+		return err
+	}
+
+	if err := s.commitKey(ctx, destPath); err != nil {
+		return err
+	}
+	return s.inner.Delete(ctx, sourcePath+KeySuffix)
+}
+
+// CopyObject copies the object together with its data key. Copying a plain
+// object drops a data key left at the destination, which would not match it.
+func (s *Store) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	encrypted, err := s.inner.ObjectExists(ctx, sourcePath+KeySuffix)
+	if err != nil {
+		return err
+	}
+
+	if !encrypted {
+		if err := s.inner.CopyObject(ctx, sourcePath, destPath); err != nil {
+			return err
+		}
+		return s.inner.Delete(ctx, destPath+KeySuffix)
+	}
+
+	if err := s.inner.CopyObject(ctx, sourcePath+KeySuffix, destPath+PendingKeySuffix); err != nil {
+		return err
+	}
+
+	if err := s.inner.CopyObject(ctx, sourcePath, destPath); err != nil {
+		_ = s.inner.Delete(context.WithoutCancel(ctx), destPath+PendingKeySuffix)
+		return err
+	}
+
+	return s.commitKey(ctx, destPath)
+}
+
+// ListObjects hides data key sidecars, pending ones included, and reports
+// plaintext sizes.
+func (s *Store) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	objects, err := s.inner.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make(map[string]bool)
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Path, KeySuffix) {
+			encrypted[strings.TrimSuffix(obj.Path, KeySuffix)] = true
+		}
+	}
+
+	visible := objects[:0]
+	for _, obj := range objects {
+		if isKey(obj.Path) {
+			continue
+		}
+		if encrypted[obj.Path] {
+			obj.Size = plaintextSize(obj.Size, s.overhead())
+		}
+		visible = append(visible, obj)
+	}
+
+	return visible, nil
+}
+
+func (s *Store) GetObjectInfo(ctx context.Context, path string) (*filestore.ObjectInfo, error) {
+	info, err := s.inner.GetObjectInfo(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := s.inner.ObjectExists(ctx, path+KeySuffix)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		info.Size = plaintextSize(info.Size, s.overhead())
+	}
+
+	return info, nil
+}
+
+func (s *Store) CreateDirectory(ctx context.Context, path string) error {
+	return s.inner.CreateDirectory(ctx, path)
+}
+
+func (s *Store) ObjectExists(ctx context.Context, path string) (bool, error) {
+	return s.inner.ObjectExists(ctx, path)
+}
+
+func (s *Store) DeleteDirectory(ctx context.Context, path string) error {
+	return s.inner.DeleteDirectory(ctx, path)
+}
+
+func (s *Store) SafeDeleteDirectory(ctx context.Context, path string) error {
+	return s.inner.SafeDeleteDirectory(ctx, path)
+}
+
+// GetDirectorySize walks the directory so that it can report plaintext sizes
+// and leave out data key sidecars.
+func (s *Store) GetDirectorySize(ctx context.Context, path string) (int64, error) {
+	if !strings.HasSuffix(path, "/") {
+		path = path + "/"
+	}
+
+	objects, err := s.ListObjects(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+
+	var totalSize int64
+	for _, obj := range objects {
+		if !obj.IsDirectory {
+			totalSize += obj.Size
+			continue
+		}
+		if obj.Path == path {
+			continue
+		}
+
+		size, err := s.GetDirectorySize(ctx, obj.Path)
+		if err != nil {
+			return 0, err
+		}
+		totalSize += size
+	}
+
+	return totalSize, nil
+}
+
+func (s *Store) DeleteDirectoryParallel(ctx context.Context, path string) error {
+	return s.inner.DeleteDirectoryParallel(ctx, path)
+}
+
+// RotateKeys re-wraps every data key under prefix that is not yet wrapped by
+// the current master key. Object data is left untouched.
+func (s *Store) RotateKeys(ctx context.Context, prefix string) (int, error) {
+	objects, err := s.inner.ListObjects(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, obj := range objects {
+		if obj.IsDirectory {
+			if obj.Path == prefix {
+				continue
+			}
+			n, err := s.RotateKeys(ctx, obj.Path)
+			rotated += n
+			if err != nil {
+				return rotated, err
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(obj.Path, KeySuffix) {
+			continue
+		}
+
+		path := strings.TrimSuffix(obj.Path, KeySuffix)
+		ok, err := s.rotateKey(ctx, path)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to rotate data key of %s: %w", path, err)
+		}
+		if ok {
+			rotated++
+		}
+	}
+
+	return rotated, nil
+}
+
+func (s *Store) rotateKey(ctx context.Context, path string) (bool, error) {
+	dk, err := s.readDataKey(ctx, path+KeySuffix)
+	if err != nil {
+		return false, err
+	}
+
+	if dk.KeyID == s.currentKeyID {
+		return false, nil
+	}
+
+	master, ok := s.masterKeys[dk.KeyID]
+	if !ok {
+		return false, fmt.Errorf("master key %q is not configured", dk.KeyID)
+	}
+
+	key, err := unwrapKey(master, dk)
+	if err != nil {
+		return false, err
+	}
+
+	wrapped, err := s.wrap(s.currentKeyID, key)
+	if err != nil {
+		return false, err
+	}
+
+	dk.KeyID = s.currentKeyID
+	dk.WrappedKey = wrapped
+	if err := s.writeDataKey(ctx, path+KeySuffix, dk); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *Store) wrap(keyID string, key []byte) ([]byte, error) {
+	master := s.masterKeys[keyID]
+
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return master.Seal(nonce, nonce, key, []byte(keyID)), nil
+}
+
+func (s *Store) unwrap(dk *dataKey) (cipher.AEAD, error) {
+	master, ok := s.masterKeys[dk.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", dk.KeyID)
+	}
+
+	if dk.ChunkSize != chunkSize {
+		return nil, fmt.Errorf("unsupported chunk size %d", dk.ChunkSize)
+	}
+
+	key, err := unwrapKey(master, dk)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+func unwrapKey(master cipher.AEAD, dk *dataKey) ([]byte, error) {
+	if len(dk.WrappedKey) < master.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+
+	nonce, sealed := dk.WrappedKey[:master.NonceSize()], dk.WrappedKey[master.NonceSize():]
+	key, err := master.Open(nil, nonce, sealed, []byte(dk.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *Store) readDataKey(ctx context.Context, keyPath string) (*dataKey, error) {
+	r, err := s.inner.Open(ctx, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var dk dataKey
+	if err := json.NewDecoder(r).Decode(&dk); err != nil {
+		return nil, fmt.Errorf("failed to read data key: %w", err)
+	}
+	return &dk, nil
+}
+
+func (s *Store) writeDataKey(ctx context.Context, keyPath string, dk *dataKey) error {
+	w, err := s.inner.Create(ctx, keyPath)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(dk); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write data key: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write data key: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) overhead() int {
+	return s.masterKeys[s.currentKeyID].Overhead()
+}
@@ -0,0 +1,251 @@
+package encrypted
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strunetsdrive/pkg/filestore"
+	"sync"
+)
+
+// Objects are split into chunkSize plaintext chunks, each sealed separately
+// with AES-GCM. The nonce is the chunk index and the additional data marks
+// the final chunk, so chunks cannot be reordered or the object truncated.
+const chunkSize = 64 << 10
+
+func chunkNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+func chunkAAD(index int64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(index))
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// plaintextSize derives the original size from the stored size: every chunk
+// but the last is full, and every chunk carries one tag.
+func plaintextSize(cipherSize int64, overhead int) int64 {
+	sealed := int64(chunkSize + overhead)
+	if cipherSize < int64(overhead) {
+		return 0
+	}
+	chunks := (cipherSize + sealed - 1) / sealed
+	return cipherSize - chunks*int64(overhead)
+}
+
+type writer struct {
+	ctx       context.Context
+	w         filestore.Writer
+	aead      cipher.AEAD
+	buf       []byte
+	index     int64
+	stageKey  func() error
+	commitKey func() error
+	dropKey   func()
+	mu        sync.Mutex
+	closed    bool
+	err       error
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, errors.New("write to closed object")
+	}
+
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data shows up, so the final
+		// chunk is always the one sealed in Close.
+		if len(w.buf) == chunkSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (w *writer) seal(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.aead, w.index), w.buf, chunkAAD(w.index, final))
+	if _, err := w.w.Write(sealed); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	// A cancelled write must not replace the data key of a previous version.
+	if err := w.ctx.Err(); err != nil && w.err == nil {
+		w.err = err
+		w.w.Abort()
+		return err
+	}
+
+	if w.err == nil {
+		w.err = w.seal(true)
+	}
+	if w.err == nil {
+		w.err = w.stageKey()
+	}
+	if w.err != nil {
+		w.w.Abort()
+		w.dropKey()
+		return w.err
+	}
+
+	if err := w.w.Close(); err != nil {
+		w.err = err
+		w.dropKey()
+		return err
+	}
+
+	// Until the key is committed, reads fall back to the staged one.
+	w.err = w.commitKey()
+	return w.err
+}
+
+func (w *writer) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.w.Abort()
+}
+
+type reader struct {
+	r          io.ReadSeekCloser
+	aead       cipher.AEAD
+	size       int64
+	cipherSize int64
+	pos        int64
+	chunk      []byte
+	chunkIndex int64
+	mu         sync.Mutex
+}
+
+func newReader(r io.ReadSeekCloser, aead cipher.AEAD) (*reader, error) {
+	cipherSize, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine object size: %w", err)
+	}
+
+	return &reader{
+		r:          r,
+		aead:       aead,
+		size:       plaintextSize(cipherSize, aead.Overhead()),
+		cipherSize: cipherSize,
+		chunkIndex: -1,
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	index := r.pos / chunkSize
+	if index != r.chunkIndex {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.chunk[r.pos-index*chunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *reader) load(index int64) error {
+	sealedSize := int64(chunkSize + r.aead.Overhead())
+	offset := index * sealedSize
+	length := sealedSize
+	if offset+length > r.cipherSize {
+		length = r.cipherSize - offset
+	}
+
+	if _, err := r.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return fmt.Errorf("failed to read chunk %d: %w", index, err)
+	}
+
+	final := offset+length == r.cipherSize
+	chunk, err := r.aead.Open(sealed[:0], chunkNonce(r.aead, index), sealed, chunkAAD(index, final))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %d: %w", index, err)
+	}
+
+	r.chunk = chunk
+	r.chunkIndex = index
+	return nil
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *reader) Close() error {
+	return r.r.Close()
+}
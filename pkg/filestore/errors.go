@@ -0,0 +1,14 @@
+package filestore
+
+import "errors"
+
+// Backends wrap their native errors into these so callers can tell a missing
+// object apart from an unavailable backend with errors.Is.
+var (
+	ErrNotExist     = errors.New("object does not exist")
+	ErrExist        = errors.New("object already exists")
+	ErrNotEmpty     = errors.New("directory is not empty")
+	ErrInvalidPath  = errors.New("invalid object path")
+	ErrNotSupported = errors.New("operation not supported by storage backend")
+	ErrUnavailable  = errors.New("storage backend unavailable")
+)
@@ -0,0 +1,381 @@
+package faulty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"path"
+	"strunetsdrive/pkg/filestore"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by calls a rule fails. It counts as an outage, so
+// the resilient store retries it and the API answers 503.
+var ErrInjected = fmt.Errorf("injected storage fault: %w", filestore.ErrUnavailable)
+
+// ErrTruncated is returned by readers a rule cuts short.
+var ErrTruncated = fmt.Errorf("injected truncated read: %w", io.ErrUnexpectedEOF)
+
+// Operation names rules match on. They are the names the resilient store
+// uses for the same calls.
+const (
+	OpCreate    = "create"
+	OpOpen      = "open"
+	OpPresign   = "presign"
+	OpDelete    = "delete"
+	OpMkdir     = "mkdir"
+	OpMove      = "move"
+	OpCopy      = "copy"
+	OpList      = "list"
+	OpStat      = "stat"
+	OpExists    = "exists"
+	OpDeleteDir = "delete_dir"
+	OpDirSize   = "dir_size"
+)
+
+// Rule describes the faults injected into matching calls.
+type Rule struct {
+	// Op is the operation the rule applies to; empty or "*" matches all.
+	Op string
+	// Pattern is a path.Match pattern for the key, where "*" does not cross
+	// "/". Empty matches every key.
+	Pattern string
+	// Rate is the fraction of matching calls that are affected, 1 if unset.
+	Rate float64
+	// Latency delays every affected call.
+	Latency time.Duration
+	// Error fails affected calls with ErrInjected without reaching the
+	// backend.
+	Error bool
+	// TruncateAfter makes readers of affected opens fail with ErrTruncated
+	// once they reach that offset.
+	TruncateAfter *int64
+	// FailClose makes Close of affected creates discard the object and
+	// return ErrInjected.
+	FailClose bool
+	// Limit caps how many calls the rule affects; zero means no limit.
+	Limit int
+}
+
+func (r *Rule) validate() error {
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("rule pattern %q: %w", r.Pattern, err)
+	}
+	if r.Rate < 0 || r.Rate > 1 {
+		return fmt.Errorf("rule rate %v is not between 0 and 1", r.Rate)
+	}
+	if r.TruncateAfter != nil && *r.TruncateAfter < 0 {
+		return fmt.Errorf("rule truncate_after %d is negative", *r.TruncateAfter)
+	}
+	return nil
+}
+
+func (r *Rule) matches(op, key string) bool {
+	if r.Op != "" && r.Op != "*" && r.Op != op {
+		return false
+	}
+	if r.Pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Pattern, key)
+	return ok
+}
+
+type rule struct {
+	Rule
+	hits int
+}
+
+// Store injects latency, errors, truncated reads and failed writes into
+// calls to inner, as described by its rules. The first rule matching a call
+// decides what happens to it. It exists to test failure handling and must
+// not be enabled in production.
+type Store struct {
+	inner filestore.Store
+
+	mu    sync.Mutex
+	rules []*rule
+}
+
+func NewStore(inner filestore.Store, rules []Rule) (*Store, error) {
+	s := &Store{inner: inner}
+	if err := s.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetRules replaces the rules, resetting their limits.
+func (s *Store) SetRules(rules []Rule) error {
+	compiled := make([]*rule, 0, len(rules))
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		compiled = append(compiled, &rule{Rule: rules[i]})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules = compiled
+	return nil
+}
+
+// Rules returns the current rules.
+func (s *Store) Rules() []Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules := make([]Rule, 0, len(s.rules))
+	for _, r := range s.rules {
+		rules = append(rules, r.Rule)
+	}
+	return rules
+}
+
+// pick returns the rule affecting a call, or nil if the call is left alone.
+func (s *Store) pick(op, key string) *Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.rules {
+		if !r.matches(op, key) {
+			continue
+		}
+		if r.Limit > 0 && r.hits >= r.Limit {
+			return nil
+		}
+		if r.Rate > 0 && r.Rate < 1 && rand.Float64() >= r.Rate {
+			return nil
+		}
+		r.hits++
+
+		affected := r.Rule
+		return &affected
+	}
+	return nil
+}
+
+// inject applies the latency and error of the rule affecting a call and
+// returns the rule so the caller can apply the rest.
+func (s *Store) inject(ctx context.Context, op, key string) (*Rule, error) {
+	r := s.pick(op, key)
+	if r == nil {
+		return nil, nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"op":   op,
+		"path": key,
+	}).Debug("faults: injecting")
+
+	if r.Latency > 0 {
+		if err := sleep(ctx, r.Latency); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Error {
+		return nil, fmt.Errorf("%s %s: %w", op, key, ErrInjected)
+	}
+	return r, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Store) Create(ctx context.Context, key string) (filestore.Writer, error) {
+	r, err := s.inject(ctx, OpCreate, key)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := s.inner.Create(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if r != nil && r.FailClose {
+		return &failingWriter{Writer: w, key: key}, nil
+	}
+	return w, nil
+}
+
+func (s *Store) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	r, err := s.inject(ctx, OpOpen, key)
+	if err != nil {
+		return nil, err
+	}
+
+	rd, err := s.inner.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if r != nil && r.TruncateAfter != nil {
+		return &truncatedReader{ReadSeekCloser: rd, limit: *r.TruncateAfter}, nil
+	}
+	return rd, nil
+}
+
+func (s *Store) GetPresignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if _, err := s.inject(ctx, OpPresign, key); err != nil {
+		return "", err
+	}
+	return s.inner.GetPresignedURL(ctx, key, expires)
+}
+
+func (s *Store) GetPresignedPutURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if _, err := s.inject(ctx, OpPresign, key); err != nil {
+		return "", err
+	}
+	return s.inner.GetPresignedPutURL(ctx, key, expires)
+}
+
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if _, err := s.inject(ctx, OpDelete, key); err != nil {
+		return err
+	}
+	return s.inner.Delete(ctx, key)
+}
+
+func (s *Store) CreateDirectory(ctx context.Context, key string) error {
+	if _, err := s.inject(ctx, OpMkdir, key); err != nil {
+		return err
+	}
+	return s.inner.CreateDirectory(ctx, key)
+}
+
+func (s *Store) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	if _, err := s.inject(ctx, OpMove, sourcePath); err != nil {
+		return err
+	}
+	return s.inner.MoveObject(ctx, sourcePath, destPath)
+}
+
+func (s *Store) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	if _, err := s.inject(ctx, OpCopy, sourcePath); err != nil {
+		return err
+	}
+	return s.inner.CopyObject(ctx, sourcePath, destPath)
+}
+
+func (s *Store) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	if _, err := s.inject(ctx, OpList, prefix); err != nil {
+		return nil, err
+	}
+	return s.inner.ListObjects(ctx, prefix)
+}
+
+func (s *Store) GetObjectInfo(ctx context.Context, key string) (*filestore.ObjectInfo, error) {
+	if _, err := s.inject(ctx, OpStat, key); err != nil {
+		return nil, err
+	}
+	return s.inner.GetObjectInfo(ctx, key)
+}
+
+func (s *Store) ObjectExists(ctx context.Context, key string) (bool, error) {
+	if _, err := s.inject(ctx, OpExists, key); err != nil {
+		return false, err
+	}
+	return s.inner.ObjectExists(ctx, key)
+}
+
+func (s *Store) DeleteDirectory(ctx context.Context, key string) error {
+	if _, err := s.inject(ctx, OpDeleteDir, key); err != nil {
+		return err
+	}
+	return s.inner.DeleteDirectory(ctx, key)
+}
+
+func (s *Store) SafeDeleteDirectory(ctx context.Context, key string) error {
+	if _, err := s.inject(ctx, OpDeleteDir, key); err != nil {
+		return err
+	}
+	return s.inner.SafeDeleteDirectory(ctx, key)
+}
+
+func (s *Store) GetDirectorySize(ctx context.Context, key string) (int64, error) {
+	if _, err := s.inject(ctx, OpDirSize, key); err != nil {
+		return 0, err
+	}
+	return s.inner.GetDirectorySize(ctx, key)
+}
+
+func (s *Store) DeleteDirectoryParallel(ctx context.Context, key string) error {
+	if _, err := s.inject(ctx, OpDeleteDir, key); err != nil {
+		return err
+	}
+	return s.inner.DeleteDirectoryParallel(ctx, key)
+}
+
+// failingWriter accepts every write and then refuses to store the object.
+type failingWriter struct {
+	filestore.Writer
+	key    string
+	closed bool
+}
+
+func (w *failingWriter) Close() error {
+	err := fmt.Errorf("close %s: %w", w.key, ErrInjected)
+	if w.closed {
+		return err
+	}
+	w.closed = true
+
+	if abortErr := w.Writer.Abort(); abortErr != nil {
+		return errors.Join(err, abortErr)
+	}
+	return err
+}
+
+func (w *failingWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.Writer.Abort()
+}
+
+// truncatedReader fails reads at or beyond limit, wherever the reader was
+// seeked to.
+type truncatedReader struct {
+	io.ReadSeekCloser
+	limit int64
+	pos   int64
+}
+
+func (r *truncatedReader) Read(p []byte) (int, error) {
+	if r.pos >= r.limit {
+		return 0, ErrTruncated
+	}
+	if remaining := r.limit - r.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.ReadSeekCloser.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *truncatedReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
@@ -1,23 +1,80 @@
 package filestore
 
 import (
+	"context"
+	"fmt"
 	"io"
-	"strunetsdrive/pkg/filestore/minio"
 	"time"
 )
 
+type ObjectInfo struct {
+	Path         string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	IsDirectory  bool
+}
+
+// Writer receives the content of a new object. Close blocks until the object
+// is durable and returns the backend error if it could not be stored; Abort
+// discards everything written so far and leaves any previous object intact.
+// Cancelling the context passed to Create aborts the writer: later writes and
+// Close fail with the context's error and nothing is stored.
+type Writer interface {
+	io.Writer
+	Close() error
+	Abort() error
+}
+
+// Store is implemented by every storage backend and decorator. The context
+// passed to Open also bounds reads from the returned reader.
+//
+// GetPresignedPutURL lets a client upload an object straight to the backend.
+// Backends without upload URLs, and decorators that have to see the content
+// to store it, return ErrNotSupported.
+//
+// CopyObject duplicates an object without routing its content through the
+// caller where the backend allows it, replacing any object at destPath.
 type Store interface {
-	Create(path string) (io.WriteCloser, error)
-	Open(path string) (io.ReadSeekCloser, error)
-	GetPresignedURL(path string, expires time.Duration) (string, error)
-	Delete(path string) error
-	CreateDirectory(path string) error
-	MoveObject(sourcePath, destPath string) error
-	ListObjects(prefix string) ([]minio.ObjectInfo, error)
-	GetObjectInfo(path string) (*minio.ObjectInfo, error)
-	ObjectExists(path string) (bool, error)
-	DeleteDirectory(path string) error
-	SafeDeleteDirectory(path string) error
-	GetDirectorySize(path string) (int64, error)
-	DeleteDirectoryParallel(path string) error
+	Create(ctx context.Context, path string) (Writer, error)
+	Open(ctx context.Context, path string) (io.ReadSeekCloser, error)
+	GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error)
+	GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error)
+	Delete(ctx context.Context, path string) error
+	CreateDirectory(ctx context.Context, path string) error
+	MoveObject(ctx context.Context, sourcePath, destPath string) error
+	CopyObject(ctx context.Context, sourcePath, destPath string) error
+	ListObjects(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	GetObjectInfo(ctx context.Context, path string) (*ObjectInfo, error)
+	ObjectExists(ctx context.Context, path string) (bool, error)
+	DeleteDirectory(ctx context.Context, path string) error
+	SafeDeleteDirectory(ctx context.Context, path string) error
+	GetDirectorySize(ctx context.Context, path string) (int64, error)
+	DeleteDirectoryParallel(ctx context.Context, path string) error
+}
+
+// StreamCopy reads sourcePath from one store and writes it to destPath in
+// another, which may be the same store. Backends without a native copy use
+// it for CopyObject.
+func StreamCopy(ctx context.Context, from Store, sourcePath string, to Store, destPath string) error {
+	r, err := from.Open(ctx, sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to copy object %s: %w", sourcePath, err)
+	}
+	defer r.Close()
+
+	w, err := to.Create(ctx, destPath)
+	if err != nil {
+		return fmt.Errorf("failed to copy object %s: %w", sourcePath, err)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Abort()
+		return fmt.Errorf("failed to copy object %s: %w", sourcePath, err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to store copy %s: %w", destPath, err)
+	}
+	return nil
 }
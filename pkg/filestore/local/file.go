@@ -1,23 +1,26 @@
 package local
 
 import (
+	"context"
 	"os"
 	"sync"
 )
 
 type File struct {
+	ctx  context.Context
 	file *os.File
 	mu   sync.Mutex
 	size int64
 }
 
-func NewFile(f *os.File) (*File, error) {
+func NewFile(ctx context.Context, f *os.File) (*File, error) {
 	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
 	return &File{
+		ctx:  ctx,
 		file: f,
 		mu:   sync.Mutex{},
 		size: info.Size(),
@@ -27,6 +30,10 @@ func NewFile(f *os.File) (*File, error) {
 func (f *File) Read(p []byte) (n int, err error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
 	return f.file.Read(p)
 }
 
@@ -46,23 +53,78 @@ func (f *File) Size() int64 {
 	return f.size
 }
 
+// Writer streams into a temporary file and only renames it onto the target
+// path on Close, so readers never observe a partially written object.
+// Cancelling ctx turns Close into Abort.
 type Writer struct {
-	file *os.File
-	mu   sync.Mutex
+	ctx    context.Context
+	file   *os.File
+	path   string
+	mu     sync.Mutex
+	closed bool
 }
 
-func NewWriter(f *os.File) *Writer {
-	return &Writer{f, sync.Mutex{}}
+func NewWriter(ctx context.Context, f *os.File, path string) *Writer {
+	return &Writer{ctx: ctx, file: f, path: path}
 }
 
 func (w *Writer) Write(p []byte) (n int, err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
 	return w.file.Write(p)
 }
 
 func (w *Writer) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	return w.file.Close()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	tmpPath := w.file.Name()
+	if err := w.ctx.Err(); err != nil {
+		w.file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := w.file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, w.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+func (w *Writer) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.file.Close()
+	return os.Remove(w.file.Name())
 }
@@ -1,60 +1,392 @@
 package local
 
-//import (
-//	"os"
-//	"path/filepath"
-//	"strunetsdrive/pkg/filestore"
-//)
-//
-//type Store struct {
-//	rootDir string
-//}
-//
-//func NewStore(rootDir string) (*Store, error) {
-//	if err := os.MkdirAll(rootDir, 0700); err != nil {
-//		return nil, err
-//	}
-//	return &Store{rootDir: rootDir}, nil
-//}
-//
-//func (s *Store) Create(path string) (filestore.Writer, error) {
-//	fullPath := filepath.Join(s.rootDir, path)
-//
-//	dir := filepath.Dir(fullPath)
-//	if err := os.MkdirAll(dir, 0700); err != nil {
-//		return nil, err
-//	}
-//
-//	file, err := os.Create(fullPath)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	return NewWriter(file), nil
-//}
-//
-//func (s *Store) Open(path string) (filestore.Reader, error) {
-//	fullPath := filepath.Join(s.rootDir, path)
-//
-//	file, err := os.Open(fullPath)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	return NewFile(file)
-//}
-//
-//func (s *Store) Remove(path string) error {
-//	return os.Remove(filepath.Join(s.rootDir, path))
-//}
-//
-//func (s *Store) Exists(path string) (bool, error) {
-//	_, err := os.Stat(filepath.Join(s.rootDir, path))
-//	if os.IsNotExist(err) {
-//		return false, nil
-//	}
-//	if err != nil {
-//		return false, err
-//	}
-//	return true, nil
-//}
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"strunetsdrive/pkg/filestore"
+	"syscall"
+	"time"
+)
+
+const tempPrefix = ".tmp-"
+
+type Store struct {
+	rootDir string
+}
+
+func NewStore(rootDir string) (*Store, error) {
+	root, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve root directory: %w", err)
+	}
+
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create root directory: %w", err)
+	}
+
+	return &Store{rootDir: root}, nil
+}
+
+// resolve maps an object key onto the filesystem and rejects keys that would
+// escape the root directory.
+func (s *Store) resolve(path string) (string, error) {
+	fullPath := filepath.Join(s.rootDir, filepath.FromSlash(path))
+
+	rel, err := filepath.Rel(s.rootDir, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q", filestore.ErrInvalidPath, path)
+	}
+
+	return fullPath, nil
+}
+
+// key converts a filesystem path back into a slash separated object key.
+func (s *Store) key(fullPath string) string {
+	rel, _ := filepath.Rel(s.rootDir, fullPath)
+	return filepath.ToSlash(rel)
+}
+
+func (s *Store) Create(ctx context.Context, path string) (filestore.Writer, error) {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create parent directory: %w", wrapError(err))
+	}
+
+	file, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", wrapError(err))
+	}
+
+	return NewWriter(ctx, file, fullPath), nil
+}
+
+func (s *Store) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object: %w", wrapError(err))
+	}
+
+	f, err := NewFile(ctx, file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open object: %w", wrapError(err))
+	}
+
+	return f, nil
+}
+
+func (s *Store) GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("presigned urls: %w", filestore.ErrNotSupported)
+}
+
+func (s *Store) GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("presigned urls: %w", filestore.ErrNotSupported)
+}
+
+func (s *Store) Delete(ctx context.Context, path string) error {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(fullPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete object: %w", wrapError(err))
+	}
+
+	return nil
+}
+
+func (s *Store) CreateDirectory(ctx context.Context, path string) error {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(fullPath, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", wrapError(err))
+	}
+
+	return nil
+}
+
+func (s *Store) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	src, err := s.resolve(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	dst, err := s.resolve(destPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", wrapError(err))
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("failed to move object: %w", wrapError(err))
+	}
+
+	return nil
+}
+
+// CopyObject hard links the copy to the source, which is safe because
+// writers replace objects by renaming instead of modifying them. Where the
+// filesystem refuses the link, the content is copied.
+func (s *Store) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	src, err := s.resolve(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	dst, err := s.resolve(destPath)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to copy object: %w", wrapError(err))
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%w: %q is a directory", filestore.ErrInvalidPath, sourcePath)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", wrapError(err))
+	}
+
+	if err := link(src, dst); err == nil {
+		return nil
+	}
+
+	return filestore.StreamCopy(ctx, s, sourcePath, s, destPath)
+}
+
+// link points dst at the inode of src. os.Link does not replace an existing
+// dst, so the link is made under a temporary name and renamed into place.
+func link(src, dst string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	tmp.Close()
+
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+
+	if err := os.Link(src, name); err != nil {
+		return err
+	}
+
+	if err := os.Rename(name, dst); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// ListObjects mirrors a non-recursive S3 listing: every entry whose key starts
+// with prefix is returned, and directories are reported with a trailing slash.
+func (s *Store) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	dirKey, namePrefix := "", prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dirKey, namePrefix = prefix[:i+1], prefix[i+1:]
+	}
+
+	dir, err := s.resolve(dirKey)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list objects: %w", wrapError(err))
+	}
+
+	var objects []filestore.ObjectInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, tempPrefix) || !strings.HasPrefix(name, namePrefix) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list objects: %w", wrapError(err))
+		}
+
+		objects = append(objects, s.objectInfo(filepath.Join(dir, name), info))
+	}
+
+	return objects, nil
+}
+
+func (s *Store) GetObjectInfo(ctx context.Context, path string) (*filestore.ObjectInfo, error) {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object info: %w", wrapError(err))
+	}
+
+	objectInfo := s.objectInfo(fullPath, info)
+	return &objectInfo, nil
+}
+
+func (s *Store) objectInfo(fullPath string, info fs.FileInfo) filestore.ObjectInfo {
+	objectInfo := filestore.ObjectInfo{
+		Path:         s.key(fullPath),
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		IsDirectory:  info.IsDir(),
+	}
+
+	if info.IsDir() {
+		objectInfo.Path += "/"
+		objectInfo.Size = 0
+		objectInfo.ContentType = "application/x-directory"
+	} else if objectInfo.ContentType = mime.TypeByExtension(filepath.Ext(fullPath)); objectInfo.ContentType == "" {
+		objectInfo.ContentType = "application/octet-stream"
+	}
+
+	return objectInfo
+}
+
+func (s *Store) ObjectExists(ctx context.Context, path string) (bool, error) {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *Store) DeleteDirectory(ctx context.Context, path string) error {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	if fullPath == s.rootDir {
+		return fmt.Errorf("%w: refusing to delete storage root", filestore.ErrInvalidPath)
+	}
+
+	if err := os.RemoveAll(fullPath); err != nil {
+		return fmt.Errorf("failed to delete directory: %w", wrapError(err))
+	}
+
+	return nil
+}
+
+func (s *Store) SafeDeleteDirectory(ctx context.Context, path string) error {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", wrapError(err))
+	}
+
+	if len(entries) > 0 {
+		return fmt.Errorf("directory %s: %w", path, filestore.ErrNotEmpty)
+	}
+
+	if err := os.Remove(fullPath); err != nil {
+		return fmt.Errorf("failed to delete directory: %w", wrapError(err))
+	}
+
+	return nil
+}
+
+func (s *Store) GetDirectorySize(ctx context.Context, path string) (int64, error) {
+	fullPath, err := s.resolve(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var totalSize int64
+	err = filepath.WalkDir(fullPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		totalSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute directory size: %w", wrapError(err))
+	}
+
+	return totalSize, nil
+}
+
+// DeleteDirectoryParallel exists for parity with the MinIO store; a single
+// RemoveAll is already as fast as the filesystem allows.
+func (s *Store) DeleteDirectoryParallel(ctx context.Context, path string) error {
+	return s.DeleteDirectory(ctx, path)
+}
+
+// wrapError attaches the matching filestore sentinel to a filesystem error
+// while keeping the original error in the chain.
+func wrapError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%w: %w", filestore.ErrNotExist, err)
+	case errors.Is(err, fs.ErrExist):
+		return fmt.Errorf("%w: %w", filestore.ErrExist, err)
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return fmt.Errorf("%w: %w", filestore.ErrNotEmpty, err)
+	}
+	return err
+}
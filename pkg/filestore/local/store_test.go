@@ -0,0 +1,17 @@
+package local
+
+import (
+	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/storetest"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) filestore.Store {
+		s, err := NewStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
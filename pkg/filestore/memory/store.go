@@ -0,0 +1,297 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"strunetsdrive/pkg/filestore"
+	"sync"
+	"time"
+)
+
+type object struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+}
+
+// Store keeps every object in a map guarded by a mutex. It follows the MinIO
+// store's key semantics (directories are "path/" markers or implied by keys)
+// and is meant for tests and throwaway deployments.
+type Store struct {
+	mu      sync.RWMutex
+	objects map[string]*object
+}
+
+func NewStore() *Store {
+	return &Store{objects: make(map[string]*object)}
+}
+
+type Writer struct {
+	ctx    context.Context
+	store  *Store
+	path   string
+	buf    bytes.Buffer
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+func (s *Store) Create(ctx context.Context, path string) (filestore.Writer, error) {
+	if path == "" || strings.HasSuffix(path, "/") {
+		return nil, fmt.Errorf("%w: %q", filestore.ErrInvalidPath, path)
+	}
+
+	return &Writer{ctx: ctx, store: s, path: path}, nil
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, fmt.Errorf("write to closed object %s", w.path)
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+// Close publishes the buffered content, so the object only becomes visible
+// once it is complete.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	if w.err = w.ctx.Err(); w.err != nil {
+		w.buf.Reset()
+		return w.err
+	}
+
+	w.store.put(w.path, bytes.Clone(w.buf.Bytes()), "application/octet-stream")
+	return nil
+}
+
+func (w *Writer) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	w.buf.Reset()
+	return nil
+}
+
+type Reader struct {
+	*bytes.Reader
+}
+
+func (r *Reader) Close() error {
+	return nil
+}
+
+func (s *Store) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[path]
+	if !ok {
+		return nil, fmt.Errorf("failed to open object %s: %w", path, filestore.ErrNotExist)
+	}
+
+	return &Reader{bytes.NewReader(obj.data)}, nil
+}
+
+func (s *Store) GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("presigned urls: %w", filestore.ErrNotSupported)
+}
+
+func (s *Store) GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("presigned urls: %w", filestore.ErrNotSupported)
+}
+
+func (s *Store) Delete(ctx context.Context, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects, path)
+	return nil
+}
+
+func (s *Store) CreateDirectory(ctx context.Context, path string) error {
+	s.put(dirKey(path), nil, "application/x-directory")
+	return nil
+}
+
+func (s *Store) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[sourcePath]
+	if !ok {
+		return fmt.Errorf("failed to move object %s: %w", sourcePath, filestore.ErrNotExist)
+	}
+
+	delete(s.objects, sourcePath)
+	s.objects[destPath] = obj
+	return nil
+}
+
+// CopyObject shares the source's data with the copy; stored data is never
+// modified, writers replace it.
+func (s *Store) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[sourcePath]
+	if !ok {
+		return fmt.Errorf("failed to copy object %s: %w", sourcePath, filestore.ErrNotExist)
+	}
+
+	s.objects[destPath] = &object{
+		data:         obj.data,
+		contentType:  obj.contentType,
+		lastModified: time.Now(),
+	}
+	return nil
+}
+
+func (s *Store) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var objects []filestore.ObjectInfo
+	for key, obj := range s.objects {
+		if key == prefix || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+			dir := key[:len(prefix)+i+1]
+			if !seen[dir] {
+				seen[dir] = true
+				objects = append(objects, filestore.ObjectInfo{
+					Path:        dir,
+					ContentType: "application/x-directory",
+					IsDirectory: true,
+				})
+			}
+			continue
+		}
+
+		objects = append(objects, obj.info(key))
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+
+	return objects, nil
+}
+
+func (s *Store) GetObjectInfo(ctx context.Context, path string) (*filestore.ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[path]
+	if !ok {
+		return nil, fmt.Errorf("failed to get object info %s: %w", path, filestore.ErrNotExist)
+	}
+
+	info := obj.info(path)
+	return &info, nil
+}
+
+func (s *Store) ObjectExists(ctx context.Context, path string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.objects[path]
+	return ok, nil
+}
+
+func (s *Store) DeleteDirectory(ctx context.Context, path string) error {
+	prefix := dirKey(path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.objects, key)
+		}
+	}
+	return nil
+}
+
+func (s *Store) SafeDeleteDirectory(ctx context.Context, path string) error {
+	prefix := dirKey(path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.objects {
+		if key != prefix && strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("directory %s: %w", path, filestore.ErrNotEmpty)
+		}
+	}
+
+	delete(s.objects, prefix)
+	return nil
+}
+
+func (s *Store) GetDirectorySize(ctx context.Context, path string) (int64, error) {
+	prefix := dirKey(path)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var totalSize int64
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			totalSize += int64(len(obj.data))
+		}
+	}
+	return totalSize, nil
+}
+
+func (s *Store) DeleteDirectoryParallel(ctx context.Context, path string) error {
+	return s.DeleteDirectory(ctx, path)
+}
+
+func (s *Store) put(path string, data []byte, contentType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[path] = &object{
+		data:         data,
+		contentType:  contentType,
+		lastModified: time.Now(),
+	}
+}
+
+func (o *object) info(path string) filestore.ObjectInfo {
+	return filestore.ObjectInfo{
+		Path:         path,
+		Size:         int64(len(o.data)),
+		ContentType:  o.contentType,
+		LastModified: o.lastModified,
+		IsDirectory:  strings.HasSuffix(path, "/"),
+	}
+}
+
+func dirKey(path string) string {
+	if !strings.HasSuffix(path, "/") {
+		return path + "/"
+	}
+	return path
+}
@@ -0,0 +1,13 @@
+package memory
+
+import (
+	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/storetest"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) filestore.Store {
+		return NewStore()
+	})
+}
@@ -0,0 +1,286 @@
+package minio
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"strunetsdrive/pkg/filestore"
+)
+
+// Layout schemes. The store keys the rest of the application sees are the
+// same in every layout; only where they end up in MinIO differs. Top-level
+// directories listed in Layout.Shared hold no tenant and stay where
+// LayoutFlat puts them in every scheme.
+const (
+	// LayoutFlat stores every key as is in the configured bucket.
+	LayoutFlat = "flat"
+	// LayoutTenantBuckets gives every top-level directory, the tenant, a
+	// bucket of its own named "<bucket>-<tenant>", created on first write.
+	LayoutTenantBuckets = "tenant-buckets"
+	// LayoutHashed nests every top-level directory under two hex digits of
+	// its SHA-256, spreading users over 256 prefixes of the bucket.
+	LayoutHashed = "hashed"
+)
+
+// tenantMarker is stored in every tenant bucket and holds the tenant name,
+// which the bucket name may only carry hashed.
+const tenantMarker = ".tenant"
+
+// Layout maps store keys onto buckets and object keys.
+type Layout struct {
+	// Prefix is prepended to every object key, e.g. "staging/".
+	Prefix string
+	// Scheme is one of the Layout constants; empty means LayoutFlat.
+	Scheme string
+	// Shared lists the top-level directories that belong to no tenant, such
+	// as the deduplicated blobs every user may reference.
+	Shared []string
+}
+
+func (l Layout) validate() error {
+	switch l.Scheme {
+	case "", LayoutFlat, LayoutTenantBuckets, LayoutHashed:
+	default:
+		return fmt.Errorf("unknown key layout %q", l.Scheme)
+	}
+	if l.Prefix != "" && !strings.HasSuffix(l.Prefix, "/") {
+		return fmt.Errorf("key prefix %q must end with a slash", l.Prefix)
+	}
+	return nil
+}
+
+// nested reports whether the layout places top-level directories somewhere
+// a plain listing of the bucket does not show them.
+func (l Layout) nested() bool {
+	return l.Scheme == LayoutTenantBuckets || l.Scheme == LayoutHashed
+}
+
+// shared reports whether the top-level directory dir belongs to no tenant.
+func (l Layout) shared(dir string) bool {
+	return slices.Contains(l.Shared, dir)
+}
+
+// splitTenant splits a key into its top-level directory and the rest.
+func splitTenant(key string) (string, string) {
+	tenant, rest, found := strings.Cut(key, "/")
+	if !found {
+		return key, ""
+	}
+	return tenant, rest
+}
+
+func shard(tenant string) string {
+	sum := sha256.Sum256([]byte(tenant))
+	return hex.EncodeToString(sum[:1])
+}
+
+var bucketSuffix = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// tenantBucket names the bucket of tenant. Tenants that cannot appear in a
+// bucket name verbatim are hashed.
+func (m *MinioStore) tenantBucket(tenant string) string {
+	name := m.bucketName + "-" + tenant
+	if len(name) <= 63 && bucketSuffix.MatchString(tenant) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(tenant))
+	return m.bucketName + "-t" + hex.EncodeToString(sum[:10])
+}
+
+// locate returns the bucket and object key a store key is stored at.
+func (m *MinioStore) locate(key string) (string, string, error) {
+	if tenant, _ := splitTenant(key); m.layout.shared(tenant) {
+		return m.bucketName, m.layout.Prefix + key, nil
+	}
+
+	switch m.layout.Scheme {
+	case LayoutTenantBuckets:
+		tenant, rest := splitTenant(key)
+		if tenant == "" || !strings.Contains(key, "/") {
+			return "", "", fmt.Errorf("%w: %q has no tenant directory", filestore.ErrInvalidPath, key)
+		}
+		return m.tenantBucket(tenant), m.layout.Prefix + rest, nil
+	case LayoutHashed:
+		tenant, _ := splitTenant(key)
+		return m.bucketName, m.layout.Prefix + shard(tenant) + "/" + key, nil
+	default:
+		return m.bucketName, m.layout.Prefix + key, nil
+	}
+}
+
+// locateForWrite is locate for calls that store something, creating a
+// missing tenant bucket on the way.
+func (m *MinioStore) locateForWrite(ctx context.Context, key string) (string, string, error) {
+	bucket, object, err := m.locate(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if tenant, _ := splitTenant(key); m.layout.Scheme == LayoutTenantBuckets && !m.layout.shared(tenant) {
+		if err := m.ensureBucket(ctx, bucket, tenant); err != nil {
+			return "", "", err
+		}
+	}
+	return bucket, object, nil
+}
+
+func (m *MinioStore) ensureBucket(ctx context.Context, bucket, tenant string) error {
+	if _, ok := m.buckets.Load(bucket); ok {
+		return nil
+	}
+
+	exists, err := m.client.BucketExists(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("failed to check bucket %s: %w", bucket, wrapError(err))
+	}
+
+	if !exists {
+		err := m.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{})
+		if err != nil && minio.ToErrorResponse(err).Code != "BucketAlreadyOwnedByYou" {
+			return fmt.Errorf("failed to create bucket %s: %w", bucket, wrapError(err))
+		}
+
+		_, err = m.client.PutObject(ctx, bucket, tenantMarker, strings.NewReader(tenant), int64(len(tenant)), minio.PutObjectOptions{
+			ContentType: "text/plain",
+		})
+		if err != nil {
+			return fmt.Errorf("failed to mark bucket %s: %w", bucket, wrapError(err))
+		}
+	}
+
+	m.buckets.Store(bucket, struct{}{})
+	return nil
+}
+
+// listTopLevel lists the top-level directories and objects of a nested
+// layout whose names start with prefix. It visits every shard or tenant
+// bucket, so it is only used when a listing cannot be located directly.
+func (m *MinioStore) listTopLevel(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	var objects []filestore.ObjectInfo
+	keep := func(obj filestore.ObjectInfo) {
+		if strings.HasPrefix(obj.Path, prefix) {
+			objects = append(objects, obj)
+		}
+	}
+
+	// The shared directories sit in the bucket root, next to the shards of
+	// LayoutHashed.
+	root, err := m.list(ctx, m.bucketName, m.layout.Prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	var shards []filestore.ObjectInfo
+	for _, entry := range root {
+		if m.layout.shared(strings.TrimSuffix(entry.Path, "/")) {
+			keep(entry)
+		} else if entry.IsDirectory {
+			shards = append(shards, entry)
+		}
+	}
+
+	if m.layout.Scheme == LayoutHashed {
+		for _, s := range shards {
+			entries, err := m.list(ctx, m.bucketName, m.layout.Prefix+s.Path, "")
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				keep(entry)
+			}
+		}
+		return objects, nil
+	}
+
+	buckets, err := m.client.ListBuckets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list buckets: %w", wrapError(err))
+	}
+	for _, bucket := range buckets {
+		if !strings.HasPrefix(bucket.Name, m.bucketName+"-") {
+			continue
+		}
+
+		tenant, err := m.readTenant(ctx, bucket.Name)
+		if err != nil {
+			return nil, err
+		}
+		if tenant == "" {
+			continue
+		}
+
+		// A bucket shared with another prefix may hold nothing of ours.
+		if m.layout.Prefix != "" {
+			entries, err := m.list(ctx, bucket.Name, m.layout.Prefix, "")
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) == 0 {
+				continue
+			}
+		}
+
+		keep(filestore.ObjectInfo{
+			Path:        tenant + "/",
+			ContentType: "application/x-directory",
+			IsDirectory: true,
+		})
+	}
+	return objects, nil
+}
+
+// readTenant returns the tenant a bucket belongs to, or "" for buckets that
+// merely share the name prefix.
+func (m *MinioStore) readTenant(ctx context.Context, bucket string) (string, error) {
+	object, err := m.client.GetObject(ctx, bucket, tenantMarker, minio.GetObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to read tenant of %s: %w", bucket, wrapError(err))
+	}
+	defer object.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, object); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read tenant of %s: %w", bucket, wrapError(err))
+	}
+	return buf.String(), nil
+}
+
+// list lists objectPrefix in bucket non-recursively and reports the entries
+// under keyPrefix, the store key objectPrefix was located from.
+func (m *MinioStore) list(ctx context.Context, bucket, objectPrefix, keyPrefix string) ([]filestore.ObjectInfo, error) {
+	opts := minio.ListObjectsOptions{
+		Prefix:    objectPrefix,
+		Recursive: false,
+	}
+
+	var objects []filestore.ObjectInfo
+	for object := range m.client.ListObjects(ctx, bucket, opts) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", wrapError(object.Err))
+		}
+
+		// Skip the directory marker of the listed prefix itself.
+		if object.Key == objectPrefix || object.Key == tenantMarker {
+			continue
+		}
+
+		objects = append(objects, filestore.ObjectInfo{
+			Path:         keyPrefix + strings.TrimPrefix(object.Key, objectPrefix),
+			Size:         object.Size,
+			ContentType:  object.ContentType,
+			LastModified: object.LastModified,
+			IsDirectory:  strings.HasSuffix(object.Key, "/"),
+		})
+	}
+
+	return objects, nil
+}
@@ -3,29 +3,33 @@ package minio
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"io"
 	"net/url"
 	"strings"
+	"strunetsdrive/pkg/filestore"
 	"sync"
 	"time"
 )
 
+// MinioStore keeps objects in bucketName, or in buckets named after it, as
+// arranged by its Layout.
 type MinioStore struct {
 	client     *minio.Client
 	bucketName string
+	layout     Layout
+	// buckets caches the tenant buckets known to exist.
+	buckets sync.Map
 }
-type ObjectInfo struct {
-	Path         string
-	Size         int64
-	ContentType  string
-	LastModified time.Time
-	IsDirectory  bool
-}
 
-func NewStore(endpoint, accessKeyID, secretAccessKey, bucketName string, useSSL bool) (*MinioStore, error) {
+func NewStore(endpoint, accessKeyID, secretAccessKey, bucketName string, useSSL bool, layout Layout) (*MinioStore, error) {
+	if err := layout.validate(); err != nil {
+		return nil, err
+	}
+
 	client, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
 		Secure: useSSL,
@@ -34,13 +38,14 @@ func NewStore(endpoint, accessKeyID, secretAccessKey, bucketName string, useSSL
 		return nil, fmt.Errorf("failed to create minio client: %w", err)
 	}
 
-	exist, err := client.BucketExists(context.Background(), bucketName)
+	ctx := context.Background()
+	exist, err := client.BucketExists(ctx, bucketName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check if bucket exists: %w", err)
 	}
 
 	if !exist {
-		err = client.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{})
+		err = client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
 		if err != nil {
 			return nil, fmt.Errorf("failed to create bucket: %w", err)
 		}
@@ -49,37 +54,51 @@ func NewStore(endpoint, accessKeyID, secretAccessKey, bucketName string, useSSL
 	return &MinioStore{
 		client:     client,
 		bucketName: bucketName,
+		layout:     layout,
 	}, nil
 
 }
 
+var errAborted = errors.New("upload aborted")
+
 type MinioWriter struct {
 	ctx        context.Context
 	client     *minio.Client
 	bucketName string
 	objectName string
 	pipeline   *io.PipeWriter
+	done       chan error
+	closeOnce  sync.Once
+	closeErr   error
 }
 
-func (m *MinioStore) Create(path string) (io.WriteCloser, error) {
+func (m *MinioStore) Create(ctx context.Context, path string) (filestore.Writer, error) {
+	bucket, object, err := m.locateForWrite(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
 	reader, writer := io.Pipe()
-	ctx := context.Background()
+	done := make(chan error, 1)
 
 	go func() {
-		_, err := m.client.PutObject(ctx, m.bucketName, path, reader, -1, minio.PutObjectOptions{
+		_, err := m.client.PutObject(ctx, bucket, object, reader, -1, minio.PutObjectOptions{
 			ContentType: "application/octet-stream",
 		})
 		if err != nil {
-			reader.CloseWithError(err)
+			err = fmt.Errorf("failed to put object: %w", wrapError(err))
 		}
+		reader.CloseWithError(err)
+		done <- err
 	}()
 
 	return &MinioWriter{
 		ctx:        ctx,
 		client:     m.client,
-		bucketName: m.bucketName,
-		objectName: path,
+		bucketName: bucket,
+		objectName: object,
 		pipeline:   writer,
+		done:       done,
 	}, nil
 }
 
@@ -87,8 +106,24 @@ func (m *MinioWriter) Write(p []byte) (n int, err error) {
 	return m.pipeline.Write(p)
 }
 
+// Close waits for PutObject to finish so the object can be used right away.
 func (m *MinioWriter) Close() error {
-	return m.pipeline.Close()
+	m.closeOnce.Do(func() {
+		m.pipeline.Close()
+		m.closeErr = <-m.done
+	})
+	return m.closeErr
+}
+
+// Abort fails the upload stream, which makes PutObject give up and abort the
+// multipart upload instead of creating the object.
+func (m *MinioWriter) Abort() error {
+	m.closeOnce.Do(func() {
+		m.pipeline.CloseWithError(errAborted)
+		<-m.done
+		m.closeErr = errAborted
+	})
+	return nil
 }
 
 type MinioReader struct {
@@ -96,11 +131,21 @@ type MinioReader struct {
 	object *minio.Object
 }
 
-func (m *MinioStore) Open(path string) (io.ReadSeekCloser, error) {
-	ctx := context.Background()
-	object, err := m.client.GetObject(ctx, m.bucketName, path, minio.GetObjectOptions{})
+func (m *MinioStore) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	bucket, key, err := m.locate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := m.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to open object: %w", err)
+		return nil, fmt.Errorf("failed to open object: %w", wrapError(err))
+	}
+
+	// GetObject is lazy, stat it so a missing key fails here and not on first read.
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, fmt.Errorf("failed to open object: %w", wrapError(err))
 	}
 
 	return &MinioReader{
@@ -121,19 +166,42 @@ func (m *MinioReader) Close() error {
 	return m.object.Close()
 }
 
-func (m *MinioStore) GetPresignedURL(path string, expires time.Duration) (string, error) {
+func (m *MinioStore) GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	bucket, object, err := m.locate(path)
+	if err != nil {
+		return "", err
+	}
+
 	reqParams := make(url.Values)
-	presignedURL, err := m.client.PresignedGetObject(context.Background(), m.bucketName, path, expires, reqParams)
+	presignedURL, err := m.client.PresignedGetObject(ctx, bucket, object, expires, reqParams)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate presigned url: %w", err)
 	}
 	return presignedURL.String(), nil
 }
 
+func (m *MinioStore) GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	bucket, object, err := m.locateForWrite(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	presignedURL, err := m.client.PresignedPutObject(ctx, bucket, object, expires)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate presigned upload url: %w", err)
+	}
+	return presignedURL.String(), nil
+}
+
 func (s *MinioStore) GetPresignedURLWithParams(path string, expires time.Duration, params url.Values) (string, error) {
+	bucket, object, err := s.locate(path)
+	if err != nil {
+		return "", err
+	}
+
 	presignedURL, err := s.client.PresignedGetObject(context.Background(),
-		s.bucketName,
-		path,
+		bucket,
+		object,
 		expires,
 		params)
 	if err != nil {
@@ -142,87 +210,135 @@ func (s *MinioStore) GetPresignedURLWithParams(path string, expires time.Duratio
 	return presignedURL.String(), nil
 }
 
-func (s *MinioStore) Delete(path string) error {
-	return s.client.RemoveObject(context.Background(), s.bucketName, path, minio.RemoveObjectOptions{})
+func (s *MinioStore) Delete(ctx context.Context, path string) error {
+	bucket, object, err := s.locate(path)
+	if err != nil {
+		return err
+	}
+
+	// The top-level directory of a tenant is its bucket, which stays.
+	if object == "" {
+		return nil
+	}
+
+	err = s.client.RemoveObject(ctx, bucket, object, minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", wrapError(err))
+	}
+	return nil
 }
 
-func (m *MinioStore) CreateDirectory(path string) error {
+func (m *MinioStore) CreateDirectory(ctx context.Context, path string) error {
 	if !strings.HasSuffix(path, "/") {
 		path = path + "/"
 	}
 
-	_, err := m.client.PutObject(
-		context.Background(),
-		m.bucketName,
-		path,
+	bucket, object, err := m.locateForWrite(ctx, path)
+	if err != nil {
+		return err
+	}
+	if object == "" {
+		return nil
+	}
+
+	_, err = m.client.PutObject(
+		ctx,
+		bucket,
+		object,
 		bytes.NewReader([]byte{}),
 		0,
 		minio.PutObjectOptions{ContentType: "application/x-directory"},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+		return fmt.Errorf("failed to create directory: %w", wrapError(err))
+	}
+	return nil
+}
+
+func (m *MinioStore) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	if err := m.CopyObject(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+
+	err := m.Delete(ctx, sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to delete source object after move: %w", err)
 	}
+
 	return nil
 }
 
-func (m *MinioStore) MoveObject(sourcePath, destPath string) error {
+// maxCopySize is the largest object a single server-side copy request can
+// copy.
+const maxCopySize = 5 << 30
+
+// CopyObject copies the object on the server, across buckets if need be.
+// Objects larger than maxCopySize are copied part by part.
+func (m *MinioStore) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	srcBucket, srcObject, err := m.locate(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	dstBucket, dstObject, err := m.locateForWrite(ctx, destPath)
+	if err != nil {
+		return err
+	}
+
 	src := minio.CopySrcOptions{
-		Bucket: m.bucketName,
-		Object: sourcePath,
+		Bucket: srcBucket,
+		Object: srcObject,
 	}
 	dst := minio.CopyDestOptions{
-		Bucket: m.bucketName,
-		Object: destPath,
+		Bucket: dstBucket,
+		Object: dstObject,
 	}
 
-	_, err := m.client.CopyObject(context.Background(), dst, src)
+	info, err := m.client.StatObject(ctx, src.Bucket, src.Object, minio.StatObjectOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to copy object: %w", err)
+		return fmt.Errorf("failed to copy object: %w", wrapError(err))
 	}
 
-	err = m.Delete(sourcePath)
+	if info.Size > maxCopySize {
+		_, err = m.client.ComposeObject(ctx, dst, src)
+	} else {
+		_, err = m.client.CopyObject(ctx, dst, src)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to delete source object after move: %w", err)
+		return fmt.Errorf("failed to copy object: %w", wrapError(err))
 	}
 
 	return nil
 }
 
-func (m *MinioStore) ListObjects(prefix string) ([]ObjectInfo, error) {
-	ctx := context.Background()
-	opts := minio.ListObjectsOptions{
-		Prefix:    prefix,
-		Recursive: false,
+// ListObjects lists prefix non-recursively. In nested layouts a prefix
+// without a complete top-level directory visits every shard or tenant.
+func (m *MinioStore) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	if m.layout.nested() && !strings.Contains(prefix, "/") {
+		return m.listTopLevel(ctx, prefix)
 	}
 
-	var objects []ObjectInfo
-	for object := range m.client.ListObjects(ctx, m.bucketName, opts) {
-		if object.Err != nil {
-			return nil, fmt.Errorf("failed to list objects: %w", object.Err)
-		}
-
-		info := ObjectInfo{
-			Path:         object.Key,
-			Size:         object.Size,
-			ContentType:  object.ContentType,
-			LastModified: object.LastModified,
-			IsDirectory:  strings.HasSuffix(object.Key, "/"),
-		}
-		objects = append(objects, info)
+	bucket, object, err := m.locate(prefix)
+	if err != nil {
+		return nil, err
 	}
 
-	return objects, nil
+	return m.list(ctx, bucket, object, prefix)
 }
 
-func (m *MinioStore) GetObjectInfo(path string) (*ObjectInfo, error) {
-	ctx := context.Background()
-	info, err := m.client.StatObject(ctx, m.bucketName, path, minio.StatObjectOptions{})
+func (m *MinioStore) GetObjectInfo(ctx context.Context, path string) (*filestore.ObjectInfo, error) {
+	bucket, object, err := m.locate(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object info: %w", err)
+		return nil, err
 	}
 
-	return &ObjectInfo{
-		Path:         info.Key,
+	info, err := m.client.StatObject(ctx, bucket, object, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object info: %w", wrapError(err))
+	}
+
+	return &filestore.ObjectInfo{
+		Path:         path,
 		Size:         info.Size,
 		ContentType:  info.ContentType,
 		LastModified: info.LastModified,
@@ -230,35 +346,36 @@ func (m *MinioStore) GetObjectInfo(path string) (*ObjectInfo, error) {
 	}, nil
 }
 
-func (m *MinioStore) ObjectExists(path string) (bool, error) {
-	_, err := m.GetObjectInfo(path)
+func (m *MinioStore) ObjectExists(ctx context.Context, path string) (bool, error) {
+	_, err := m.GetObjectInfo(ctx, path)
 	if err != nil {
-		if errResponse, ok := err.(minio.ErrorResponse); ok {
-			if errResponse.Code == "NoSuchKey" || errResponse.Code == "NoSuchObject" {
-				return false, nil
-			}
+		if errors.Is(err, filestore.ErrNotExist) {
+			return false, nil
 		}
 		return false, err
 	}
 	return true, nil
 }
 
-func (m *MinioStore) DeleteDirectory(path string) error {
-	ctx := context.Background()
-
+func (m *MinioStore) DeleteDirectory(ctx context.Context, path string) error {
 	if !strings.HasSuffix(path, "/") {
 		path = path + "/"
 	}
 
+	bucket, prefix, err := m.locate(path)
+	if err != nil {
+		return err
+	}
+
 	objectsCh := make(chan minio.ObjectInfo)
 	opts := minio.ListObjectsOptions{
-		Prefix:    path,
+		Prefix:    prefix,
 		Recursive: true,
 	}
 
 	go func() {
 		defer close(objectsCh)
-		for object := range m.client.ListObjects(ctx, m.bucketName, opts) {
+		for object := range m.client.ListObjects(ctx, bucket, opts) {
 			if object.Err != nil {
 				return
 			}
@@ -274,12 +391,12 @@ func (m *MinioStore) DeleteDirectory(path string) error {
 		}
 	}()
 
-	errorCh := m.client.RemoveObjects(ctx, m.bucketName, objectsToRemove, minio.RemoveObjectsOptions{})
+	errorCh := m.client.RemoveObjects(ctx, bucket, objectsToRemove, minio.RemoveObjectsOptions{})
 
 	var deleteErrors []error
 	for err := range errorCh {
 		if err.Err != nil {
-			deleteErrors = append(deleteErrors, fmt.Errorf("failed to delete %s: %w", err.ObjectName, err.Err))
+			deleteErrors = append(deleteErrors, fmt.Errorf("failed to delete %s: %w", err.ObjectName, wrapError(err.Err)))
 		}
 	}
 
@@ -294,34 +411,43 @@ func (m *MinioStore) DeleteDirectory(path string) error {
 	return nil
 }
 
-func (m *MinioStore) SafeDeleteDirectory(path string) error {
-	objects, err := m.ListObjects(path)
+func (m *MinioStore) SafeDeleteDirectory(ctx context.Context, path string) error {
+	if !strings.HasSuffix(path, "/") {
+		path = path + "/"
+	}
+
+	objects, err := m.ListObjects(ctx, path)
 	if err != nil {
 		return fmt.Errorf("failed to list objects: %w", err)
 	}
 
 	if len(objects) > 0 {
-		return fmt.Errorf("directory %s is not empty", path)
+		return fmt.Errorf("directory %s: %w", path, filestore.ErrNotEmpty)
 	}
 
+	return m.Delete(ctx, path)
+}
+
+func (m *MinioStore) GetDirectorySize(ctx context.Context, path string) (int64, error) {
+	var totalSize int64
+
 	if !strings.HasSuffix(path, "/") {
 		path = path + "/"
 	}
-	return m.Delete(path)
-}
 
-func (m *MinioStore) GetDirectorySize(path string) (int64, error) {
-	ctx := context.Background()
-	var totalSize int64
+	bucket, prefix, err := m.locate(path)
+	if err != nil {
+		return 0, err
+	}
 
 	opts := minio.ListObjectsOptions{
-		Prefix:    path,
+		Prefix:    prefix,
 		Recursive: true,
 	}
 
-	for object := range m.client.ListObjects(ctx, m.bucketName, opts) {
+	for object := range m.client.ListObjects(ctx, bucket, opts) {
 		if object.Err != nil {
-			return 0, fmt.Errorf("failed to list objects: %w", object.Err)
+			return 0, fmt.Errorf("failed to list objects: %w", wrapError(object.Err))
 		}
 		totalSize += object.Size
 	}
@@ -329,14 +455,18 @@ func (m *MinioStore) GetDirectorySize(path string) (int64, error) {
 	return totalSize, nil
 }
 
-func (m *MinioStore) DeleteDirectoryParallel(path string) error {
-	ctx := context.Background()
+func (m *MinioStore) DeleteDirectoryParallel(ctx context.Context, path string) error {
 	workers := 10
 
 	if !strings.HasSuffix(path, "/") {
 		path = path + "/"
 	}
 
+	bucket, prefix, err := m.locate(path)
+	if err != nil {
+		return err
+	}
+
 	objectsCh := make(chan string, 1000)
 	errorsCh := make(chan error, workers)
 	var wg sync.WaitGroup
@@ -345,25 +475,32 @@ func (m *MinioStore) DeleteDirectoryParallel(path string) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			// A failed worker keeps draining the channel so the listing
+			// below never blocks, but reports only its first error.
+			failed := false
 			for objectName := range objectsCh {
-				err := m.Delete(objectName)
+				if failed {
+					continue
+				}
+				err := m.client.RemoveObject(ctx, bucket, objectName, minio.RemoveObjectOptions{})
 				if err != nil {
-					errorsCh <- fmt.Errorf("failed to delete %s: %w", objectName, err)
-					return
+					errorsCh <- fmt.Errorf("failed to delete %s: %w", objectName, wrapError(err))
+					failed = true
 				}
 			}
 		}()
 	}
 
 	opts := minio.ListObjectsOptions{
-		Prefix:    path,
+		Prefix:    prefix,
 		Recursive: true,
 	}
 
-	for object := range m.client.ListObjects(ctx, m.bucketName, opts) {
+	for object := range m.client.ListObjects(ctx, bucket, opts) {
 		if object.Err != nil {
 			close(objectsCh)
-			return fmt.Errorf("failed to list objects: %w", object.Err)
+			wg.Wait()
+			return fmt.Errorf("failed to list objects: %w", wrapError(object.Err))
 		}
 		objectsCh <- object.Key
 	}
@@ -372,14 +509,28 @@ func (m *MinioStore) DeleteDirectoryParallel(path string) error {
 	wg.Wait()
 	close(errorsCh)
 
-	var errors []error
+	var deleteErrors []error
 	for err := range errorsCh {
-		errors = append(errors, err)
+		deleteErrors = append(deleteErrors, err)
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("deletion errors occurred: %v", errors)
+	if len(deleteErrors) > 0 {
+		return fmt.Errorf("deletion errors occurred: %v", deleteErrors)
 	}
 
 	return nil
 }
+
+// wrapError attaches the matching filestore sentinel to a MinIO error while
+// keeping the original error in the chain.
+func wrapError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchObject", "NoSuchBucket", "NoSuchVersion":
+		return fmt.Errorf("%w: %w", filestore.ErrNotExist, err)
+	case "BucketAlreadyExists", "BucketAlreadyOwnedByYou", "PreconditionFailed":
+		return fmt.Errorf("%w: %w", filestore.ErrExist, err)
+	case "BucketNotEmpty":
+		return fmt.Errorf("%w: %w", filestore.ErrNotEmpty, err)
+	}
+	return err
+}
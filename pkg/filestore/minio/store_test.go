@@ -0,0 +1,104 @@
+package minio
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strunetsdrive/pkg/filestore"
+	"strunetsdrive/pkg/filestore/storetest"
+	"testing"
+)
+
+// TestStore runs the conformance suite against a stand-in server, such as the
+// docker-compose minio service. It is skipped unless
+// STORETEST_MINIO_ENDPOINT is set; every subtest works under a key prefix of
+// its own in the bucket STORETEST_MINIO_BUCKET, "storetest" by default.
+func TestStore(t *testing.T) {
+	endpoint := os.Getenv("STORETEST_MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("STORETEST_MINIO_ENDPOINT is not set")
+	}
+
+	bucket := os.Getenv("STORETEST_MINIO_BUCKET")
+	if bucket == "" {
+		bucket = "storetest"
+	}
+
+	storetest.Run(t, func(t *testing.T) filestore.Store {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := NewStore(
+			endpoint,
+			os.Getenv("STORETEST_MINIO_ACCESS_KEY"),
+			os.Getenv("STORETEST_MINIO_SECRET_KEY"),
+			bucket,
+			os.Getenv("STORETEST_MINIO_USE_SSL") == "true",
+			Layout{Prefix: "run-" + hex.EncodeToString(id) + "/"},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			ctx := context.Background()
+			objects, err := s.ListObjects(ctx, "")
+			if err != nil {
+				t.Logf("cleanup: %v", err)
+				return
+			}
+			for _, obj := range objects {
+				if obj.IsDirectory {
+					err = s.DeleteDirectory(ctx, obj.Path)
+				} else {
+					err = s.Delete(ctx, obj.Path)
+				}
+				if err != nil {
+					t.Logf("cleanup %s: %v", obj.Path, err)
+				}
+			}
+		})
+		return s
+	})
+}
+
+func TestLocate(t *testing.T) {
+	tests := []struct {
+		scheme string
+		key    string
+		bucket string
+		object string
+	}{
+		{LayoutFlat, "alice/tmp/1", "drive", "p/alice/tmp/1"},
+		{LayoutFlat, "blobs/ab/cd/abcd", "drive", "p/blobs/ab/cd/abcd"},
+		{LayoutTenantBuckets, "alice/tmp/1", "drive-alice", "p/tmp/1"},
+		{LayoutTenantBuckets, "Alice/tmp/1", "drive-t" + hashed("Alice")[:20], "p/tmp/1"},
+		{LayoutTenantBuckets, "blobs/ab/cd/abcd", "drive", "p/blobs/ab/cd/abcd"},
+		{LayoutHashed, "alice/tmp/1", "drive", "p/" + hashed("alice")[:2] + "/alice/tmp/1"},
+		{LayoutHashed, "blobs/ab/cd/abcd", "drive", "p/blobs/ab/cd/abcd"},
+	}
+
+	for _, tt := range tests {
+		m := &MinioStore{
+			bucketName: "drive",
+			layout:     Layout{Prefix: "p/", Scheme: tt.scheme, Shared: []string{"blobs"}},
+		}
+		bucket, object, err := m.locate(tt.key)
+		if err != nil {
+			t.Errorf("%s: locate(%q): %v", tt.scheme, tt.key, err)
+			continue
+		}
+		if bucket != tt.bucket || object != tt.object {
+			t.Errorf("%s: locate(%q) = %s, %s; want %s, %s", tt.scheme, tt.key, bucket, object, tt.bucket, tt.object)
+		}
+	}
+}
+
+func hashed(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,444 @@
+package replicated
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"sort"
+	"strunetsdrive/pkg/filestore"
+	"sync"
+	"time"
+)
+
+// Store mirrors every object onto several stores. Writes go to all replicas
+// and succeed once writeQuorum of them have committed; reads try the replicas
+// in order and fail over to the next one when a replica errors. Copies that a
+// write or a failed replica missed are restored by Repair.
+type Store struct {
+	replicas    []filestore.Store
+	writeQuorum int
+}
+
+// NewStore mirrors onto replicas, the first being the preferred one for
+// reads. writeQuorum is the number of replicas a write must reach; zero
+// means all of them.
+func NewStore(replicas []filestore.Store, writeQuorum int) (*Store, error) {
+	if len(replicas) < 2 {
+		return nil, fmt.Errorf("replication needs at least 2 replicas, got %d", len(replicas))
+	}
+	if writeQuorum == 0 {
+		writeQuorum = len(replicas)
+	}
+	if writeQuorum < 1 || writeQuorum > len(replicas) {
+		return nil, fmt.Errorf("write quorum must be between 1 and %d, got %d", len(replicas), writeQuorum)
+	}
+
+	return &Store{replicas: replicas, writeQuorum: writeQuorum}, nil
+}
+
+func (s *Store) Create(ctx context.Context, path string) (filestore.Writer, error) {
+	w := &writer{path: path, quorum: s.writeQuorum}
+	var errs []error
+	for i, replica := range s.replicas {
+		rw, err := replica.Create(ctx, path)
+		if err != nil {
+			logReplicaError(i, "create", path, err)
+			errs = append(errs, err)
+			continue
+		}
+		w.writers = append(w.writers, replicaWriter{index: i, w: rw})
+	}
+
+	if len(w.writers) < s.writeQuorum {
+		w.Abort()
+		return nil, quorumError(path, errs)
+	}
+
+	return w, nil
+}
+
+// Open returns the object from the first replica that can serve it. A
+// replica failing halfway through a read is not retried.
+func (s *Store) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	return firstOf(s, "open", path, func(replica filestore.Store) (io.ReadSeekCloser, error) {
+		return replica.Open(ctx, path)
+	})
+}
+
+func (s *Store) GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return firstOf(s, "presign", path, func(replica filestore.Store) (string, error) {
+		return replica.GetPresignedURL(ctx, path, expires)
+	})
+}
+
+// GetPresignedPutURL is not supported since an upload through it would reach
+// a single replica only.
+func (s *Store) GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("presigned upload urls for replicated storage: %w", filestore.ErrNotSupported)
+}
+
+func (s *Store) GetObjectInfo(ctx context.Context, path string) (*filestore.ObjectInfo, error) {
+	return firstOf(s, "stat", path, func(replica filestore.Store) (*filestore.ObjectInfo, error) {
+		return replica.GetObjectInfo(ctx, path)
+	})
+}
+
+func (s *Store) GetDirectorySize(ctx context.Context, path string) (int64, error) {
+	return firstOf(s, "size", path, func(replica filestore.Store) (int64, error) {
+		return replica.GetDirectorySize(ctx, path)
+	})
+}
+
+// ObjectExists reports true if any replica has the object.
+func (s *Store) ObjectExists(ctx context.Context, path string) (bool, error) {
+	var errs []error
+	for i, replica := range s.replicas {
+		exists, err := replica.ObjectExists(ctx, path)
+		if err != nil {
+			logReplicaError(i, "exists", path, err)
+			errs = append(errs, err)
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+
+	if len(errs) == len(s.replicas) {
+		return false, errors.Join(errs...)
+	}
+	return false, nil
+}
+
+// ListObjects merges the listings of every reachable replica, so objects
+// that are missing on one replica are still listed.
+func (s *Store) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	merged := make(map[string]filestore.ObjectInfo)
+	var errs []error
+	for i, replica := range s.replicas {
+		objects, err := replica.ListObjects(ctx, prefix)
+		if err != nil {
+			logReplicaError(i, "list", prefix, err)
+			errs = append(errs, err)
+			continue
+		}
+		for _, obj := range objects {
+			if _, ok := merged[obj.Path]; !ok {
+				merged[obj.Path] = obj
+			}
+		}
+	}
+
+	if len(errs) == len(s.replicas) {
+		return nil, errors.Join(errs...)
+	}
+
+	objects := make([]filestore.ObjectInfo, 0, len(merged))
+	for _, obj := range merged {
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path < objects[j].Path
+	})
+	return objects, nil
+}
+
+// Delete removes the object from every replica and fails if any replica
+// could not be reached, since a surviving copy would be restored by Repair.
+func (s *Store) Delete(ctx context.Context, path string) error {
+	return s.all(func(replica filestore.Store) error {
+		return replica.Delete(ctx, path)
+	})
+}
+
+func (s *Store) CreateDirectory(ctx context.Context, path string) error {
+	return s.all(func(replica filestore.Store) error {
+		return replica.CreateDirectory(ctx, path)
+	})
+}
+
+// MoveObject moves the object on every replica that has it.
+func (s *Store) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	moved := 0
+	err := s.all(func(replica filestore.Store) error {
+		err := replica.MoveObject(ctx, sourcePath, destPath)
+		if errors.Is(err, filestore.ErrNotExist) {
+			return nil
+		}
+		if err == nil {
+			moved++
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if moved == 0 {
+		return fmt.Errorf("failed to move object %s: %w", sourcePath, filestore.ErrNotExist)
+	}
+	return nil
+}
+
+// CopyObject copies the object on every replica that has it, so the copy is
+// exactly as replicated as its source.
+func (s *Store) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	copied := 0
+	err := s.all(func(replica filestore.Store) error {
+		err := replica.CopyObject(ctx, sourcePath, destPath)
+		if errors.Is(err, filestore.ErrNotExist) {
+			return nil
+		}
+		if err == nil {
+			copied++
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if copied == 0 {
+		return fmt.Errorf("failed to copy object %s: %w", sourcePath, filestore.ErrNotExist)
+	}
+	return nil
+}
+
+func (s *Store) DeleteDirectory(ctx context.Context, path string) error {
+	return s.all(func(replica filestore.Store) error {
+		return replica.DeleteDirectory(ctx, path)
+	})
+}
+
+func (s *Store) SafeDeleteDirectory(ctx context.Context, path string) error {
+	return s.all(func(replica filestore.Store) error {
+		return replica.SafeDeleteDirectory(ctx, path)
+	})
+}
+
+func (s *Store) DeleteDirectoryParallel(ctx context.Context, path string) error {
+	return s.all(func(replica filestore.Store) error {
+		return replica.DeleteDirectoryParallel(ctx, path)
+	})
+}
+
+// Repair copies every object under prefix onto the replicas that lack it.
+// Objects modified within grace are skipped, as their write may still be in
+// progress. It returns the number of copies made.
+func (s *Store) Repair(ctx context.Context, prefix string, grace time.Duration) (int, error) {
+	present := make([]map[string]bool, len(s.replicas))
+	owner := make(map[string]int)
+	cutoff := time.Now().Add(-grace)
+
+	// Replicas are walked in reverse so that owner ends up pointing at the
+	// most preferred replica holding each object.
+	for i := len(s.replicas) - 1; i >= 0; i-- {
+		present[i] = make(map[string]bool)
+		err := filestore.Walk(ctx, s.replicas[i], prefix, func(obj filestore.ObjectInfo) error {
+			present[i][obj.Path] = true
+			if obj.LastModified.Before(cutoff) {
+				owner[obj.Path] = i
+			}
+			return nil
+		})
+		if err != nil {
+			// An unreachable replica is left alone until a later run.
+			logReplicaError(i, "repair", prefix, err)
+			present[i] = nil
+		}
+	}
+
+	paths := make([]string, 0, len(owner))
+	for path := range owner {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	copied := 0
+	var errs []error
+	for _, path := range paths {
+		for i, replica := range s.replicas {
+			if present[i] == nil || present[i][path] {
+				continue
+			}
+
+			if err := filestore.StreamCopy(ctx, s.replicas[owner[path]], path, replica, path); err != nil {
+				logReplicaError(i, "repair", path, err)
+				errs = append(errs, err)
+				continue
+			}
+			copied++
+		}
+	}
+
+	return copied, errors.Join(errs...)
+}
+
+// RunRepair repairs the whole store every interval until ctx is cancelled.
+func (s *Store) RunRepair(ctx context.Context, interval, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		copied, err := s.Repair(ctx, "", grace)
+		entry := logrus.WithField("copied", copied)
+		if err != nil {
+			entry.WithError(err).Error("replication: repair incomplete")
+			continue
+		}
+		entry.Info("replication: repair finished")
+	}
+}
+
+// firstOf returns the result of the first replica op succeeds on. ErrNotExist
+// is only reported when every replica agrees; otherwise the object may well
+// be on a replica that is down, and the outage errors are returned instead.
+func firstOf[T any](s *Store, name, path string, op func(replica filestore.Store) (T, error)) (T, error) {
+	var missing, errs []error
+	for i, replica := range s.replicas {
+		result, err := op(replica)
+		if err == nil {
+			return result, nil
+		}
+		if errors.Is(err, filestore.ErrNotExist) {
+			missing = append(missing, err)
+			continue
+		}
+		logReplicaError(i, name, path, err)
+		errs = append(errs, err)
+	}
+
+	var zero T
+	if len(errs) == 0 {
+		return zero, errors.Join(missing...)
+	}
+	return zero, errors.Join(errs...)
+}
+
+func (s *Store) all(op func(replica filestore.Store) error) error {
+	var errs []error
+	for i, replica := range s.replicas {
+		if err := op(replica); err != nil {
+			errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func logReplicaError(index int, op, path string, err error) {
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"replica": index,
+		"op":      op,
+		"path":    path,
+	}).Warn("replication: replica failed")
+}
+
+func quorumError(path string, errs []error) error {
+	return fmt.Errorf("failed to write %s to enough replicas: %w", path, errors.Join(errs...))
+}
+
+type replicaWriter struct {
+	index int
+	w     filestore.Writer
+}
+
+// writer fans writes out to every replica writer. A replica that fails is
+// aborted and dropped; the write as a whole fails once fewer than quorum
+// replicas are left.
+type writer struct {
+	path    string
+	quorum  int
+	writers []replicaWriter
+	errs    []error
+	mu      sync.Mutex
+	closed  bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, fmt.Errorf("write to closed object %s", w.path)
+	}
+
+	live := w.writers[:0]
+	for _, rw := range w.writers {
+		if _, err := rw.w.Write(p); err != nil {
+			logReplicaError(rw.index, "write", w.path, err)
+			w.errs = append(w.errs, err)
+			rw.w.Abort()
+			continue
+		}
+		live = append(live, rw)
+	}
+	w.writers = live
+
+	if len(w.writers) < w.quorum {
+		return 0, quorumError(w.path, w.errs)
+	}
+	return len(p), nil
+}
+
+// Close commits every remaining replica. If fewer than quorum commit, the
+// committed copies are left for Repair or the caller's cleanup, since a
+// committed object cannot be withdrawn atomically.
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if len(w.writers) < w.quorum {
+		w.abortAll()
+		return quorumError(w.path, w.errs)
+	}
+
+	committed := 0
+	for _, rw := range w.writers {
+		if err := rw.w.Close(); err != nil {
+			logReplicaError(rw.index, "close", w.path, err)
+			w.errs = append(w.errs, err)
+			continue
+		}
+		committed++
+	}
+
+	if committed < w.quorum {
+		return quorumError(w.path, w.errs)
+	}
+	return nil
+}
+
+func (w *writer) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.abortAll()
+}
+
+func (w *writer) abortAll() error {
+	var errs []error
+	for _, rw := range w.writers {
+		if err := rw.w.Abort(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
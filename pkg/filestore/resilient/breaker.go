@@ -0,0 +1,119 @@
+package resilient
+
+import (
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+type state int
+
+const (
+	stateClosed state = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s state) String() string {
+	switch s {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker opens after threshold consecutive failures and rejects calls until
+// cooldown has passed. It then lets a single trial call through: success
+// closes it again, failure reopens it.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    state
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(stateHalfOpen)
+		b.trial = true
+		return true
+	case stateHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record feeds the outcome of an allowed call back. Only transient failures
+// count; a missing object says nothing about the backend's health.
+func (b *breaker) record(failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		b.setState(stateClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == stateHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(stateOpen)
+	}
+}
+
+// release ends an allowed call without judging the backend, for calls the
+// caller abandoned.
+func (b *breaker) release() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+}
+
+func (b *breaker) setState(s state) {
+	if b.state == s {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"store":    b.name,
+		"from":     b.state.String(),
+		"to":       s.String(),
+		"failures": b.failures,
+	}).Warn("storage circuit breaker changed state")
+	b.state = s
+}
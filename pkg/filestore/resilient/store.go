@@ -0,0 +1,421 @@
+package resilient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"strunetsdrive/pkg/filestore"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTimeout     = fmt.Errorf("storage call timed out: %w", filestore.ErrUnavailable)
+	ErrCircuitOpen = fmt.Errorf("storage circuit breaker is open: %w", filestore.ErrUnavailable)
+)
+
+// Operation names used for Options.Timeouts and in logs.
+const (
+	OpCreate    = "create"
+	OpClose     = "close"
+	OpOpen      = "open"
+	OpPresign   = "presign"
+	OpDelete    = "delete"
+	OpMkdir     = "mkdir"
+	OpMove      = "move"
+	OpCopy      = "copy"
+	OpList      = "list"
+	OpStat      = "stat"
+	OpExists    = "exists"
+	OpDeleteDir = "delete_dir"
+	OpDirSize   = "dir_size"
+)
+
+// defaultTimeout is the Options.Timeouts key used for operations without an
+// entry of their own.
+const defaultTimeout = "default"
+
+// retryable lists the operations that can safely be repeated.
+var retryable = map[string]bool{
+	OpOpen:    true,
+	OpStat:    true,
+	OpExists:  true,
+	OpList:    true,
+	OpDelete:  true,
+	OpCopy:    true,
+	OpDirSize: true,
+}
+
+type Options struct {
+	// Timeouts bounds each operation by name, falling back to the "default"
+	// entry. Zero means no timeout.
+	Timeouts map[string]time.Duration
+	// MaxRetries is how often a retryable operation is repeated after a
+	// transient failure, waiting BaseDelay, doubled per attempt up to
+	// MaxDelay.
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// FailureThreshold consecutive transient failures open the circuit for
+	// Cooldown. Zero disables the breaker.
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+// Store guards every call to inner with a timeout, retries idempotent calls
+// with exponential backoff and stops calling inner altogether while it keeps
+// failing. A call that times out has its context cancelled and is abandoned;
+// a late result is cleaned up.
+type Store struct {
+	inner   filestore.Store
+	name    string
+	opts    Options
+	breaker *breaker
+}
+
+// NewStore wraps inner; name identifies it in logs.
+func NewStore(inner filestore.Store, name string, opts Options) *Store {
+	return &Store{
+		inner: inner,
+		name:  name,
+		opts:  opts,
+		breaker: &breaker{
+			name:      name,
+			threshold: opts.FailureThreshold,
+			cooldown:  opts.Cooldown,
+		},
+	}
+}
+
+// transient reports whether err may go away on its own. Errors describing
+// the request or the object rather than the backend are final.
+func transient(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, filestore.ErrNotExist),
+		errors.Is(err, filestore.ErrExist),
+		errors.Is(err, filestore.ErrNotEmpty),
+		errors.Is(err, filestore.ErrInvalidPath),
+		errors.Is(err, filestore.ErrNotSupported),
+		errors.Is(err, ErrCircuitOpen),
+		errors.Is(err, context.Canceled):
+		return false
+	}
+	return true
+}
+
+func (s *Store) timeout(op string) time.Duration {
+	if d, ok := s.opts.Timeouts[op]; ok {
+		return d
+	}
+	return s.opts.Timeouts[defaultTimeout]
+}
+
+func (s *Store) backoff(attempt int) time.Duration {
+	delay := s.opts.BaseDelay << attempt
+	if delay <= 0 || (s.opts.MaxDelay > 0 && delay > s.opts.MaxDelay) {
+		delay = s.opts.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Jitter keeps concurrent callers from retrying in lockstep.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// call runs fn under the breaker, the timeout for op and, for retryable
+// operations, the retry policy. fn gets a context that is cancelled when its
+// attempt times out. The returned release func cancels that context; results
+// that are used after call returns, such as readers, hold on to it until they
+// are closed. cleanup releases a result that arrives after its call timed out.
+func call[T any](ctx context.Context, s *Store, op, path string, fn func(context.Context) (T, error), cleanup func(T)) (T, context.CancelFunc, error) {
+	var zero T
+	attempts := 1
+	if retryable[op] {
+		attempts += s.opts.MaxRetries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, s.backoff(attempt-1)); err != nil {
+				return zero, nil, err
+			}
+		}
+
+		if !s.breaker.allow() {
+			return zero, nil, fmt.Errorf("%s %s: %w", op, path, ErrCircuitOpen)
+		}
+
+		var result T
+		var release context.CancelFunc
+		result, release, err = withTimeout(ctx, s.timeout(op), fn, cleanup)
+		if ctx.Err() != nil {
+			// The caller gave up, which says nothing about the backend.
+			s.breaker.release()
+			return result, release, err
+		}
+
+		s.breaker.record(transient(err))
+		if !transient(err) {
+			return result, release, err
+		}
+
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"store":   s.name,
+			"op":      op,
+			"path":    path,
+			"attempt": attempt + 1,
+		}).Warn("storage call failed")
+	}
+
+	return zero, nil, err
+}
+
+func withTimeout[T any](ctx context.Context, timeout time.Duration, fn func(context.Context) (T, error), cleanup func(T)) (T, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	if timeout <= 0 {
+		result, err := fn(ctx)
+		if err != nil {
+			cancel()
+			return result, nil, err
+		}
+		return result, cancel, nil
+	}
+
+	done := make(chan outcome[T], 1)
+	go func() {
+		result, err := fn(ctx)
+		done <- outcome[T]{result, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var zero T
+	select {
+	case o := <-done:
+		if o.err != nil {
+			cancel()
+			return o.result, nil, o.err
+		}
+		return o.result, cancel, nil
+	case <-timer.C:
+		err := fmt.Errorf("after %s: %w", timeout, ErrTimeout)
+		cancel()
+		abandon(done, cleanup)
+		return zero, nil, err
+	case <-ctx.Done():
+		cancel()
+		abandon(done, cleanup)
+		return zero, nil, ctx.Err()
+	}
+}
+
+type outcome[T any] struct {
+	result T
+	err    error
+}
+
+// abandon cleans up the result of a call nobody waits for anymore.
+func abandon[T any](done <-chan outcome[T], cleanup func(T)) {
+	if cleanup == nil {
+		return
+	}
+	go func() {
+		if o := <-done; o.err == nil {
+			cleanup(o.result)
+		}
+	}()
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// get adapts operations whose result is not used after they return to call.
+func get[T any](ctx context.Context, s *Store, op, path string, fn func(context.Context) (T, error)) (T, error) {
+	result, release, err := call(ctx, s, op, path, fn, nil)
+	if release != nil {
+		release()
+	}
+	return result, err
+}
+
+// run adapts operations that only return an error to call.
+func run(ctx context.Context, s *Store, op, path string, fn func(context.Context) error) error {
+	_, err := get(ctx, s, op, path, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
+	return err
+}
+
+func (s *Store) Create(ctx context.Context, path string) (filestore.Writer, error) {
+	w, release, err := call(ctx, s, OpCreate, path, func(ctx context.Context) (filestore.Writer, error) {
+		return s.inner.Create(ctx, path)
+	}, func(w filestore.Writer) {
+		_ = w.Abort()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &writer{ctx: ctx, store: s, path: path, w: w, release: release}, nil
+}
+
+func (s *Store) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	r, release, err := call(ctx, s, OpOpen, path, func(ctx context.Context) (io.ReadSeekCloser, error) {
+		return s.inner.Open(ctx, path)
+	}, func(r io.ReadSeekCloser) {
+		_ = r.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &reader{ReadSeekCloser: r, release: release}, nil
+}
+
+func (s *Store) GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return get(ctx, s, OpPresign, path, func(ctx context.Context) (string, error) {
+		return s.inner.GetPresignedURL(ctx, path, expires)
+	})
+}
+
+func (s *Store) GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	return get(ctx, s, OpPresign, path, func(ctx context.Context) (string, error) {
+		return s.inner.GetPresignedPutURL(ctx, path, expires)
+	})
+}
+
+func (s *Store) Delete(ctx context.Context, path string) error {
+	return run(ctx, s, OpDelete, path, func(ctx context.Context) error {
+		return s.inner.Delete(ctx, path)
+	})
+}
+
+func (s *Store) CreateDirectory(ctx context.Context, path string) error {
+	return run(ctx, s, OpMkdir, path, func(ctx context.Context) error {
+		return s.inner.CreateDirectory(ctx, path)
+	})
+}
+
+func (s *Store) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	return run(ctx, s, OpMove, sourcePath, func(ctx context.Context) error {
+		return s.inner.MoveObject(ctx, sourcePath, destPath)
+	})
+}
+
+func (s *Store) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	return run(ctx, s, OpCopy, sourcePath, func(ctx context.Context) error {
+		return s.inner.CopyObject(ctx, sourcePath, destPath)
+	})
+}
+
+func (s *Store) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	return get(ctx, s, OpList, prefix, func(ctx context.Context) ([]filestore.ObjectInfo, error) {
+		return s.inner.ListObjects(ctx, prefix)
+	})
+}
+
+func (s *Store) GetObjectInfo(ctx context.Context, path string) (*filestore.ObjectInfo, error) {
+	return get(ctx, s, OpStat, path, func(ctx context.Context) (*filestore.ObjectInfo, error) {
+		return s.inner.GetObjectInfo(ctx, path)
+	})
+}
+
+func (s *Store) ObjectExists(ctx context.Context, path string) (bool, error) {
+	return get(ctx, s, OpExists, path, func(ctx context.Context) (bool, error) {
+		return s.inner.ObjectExists(ctx, path)
+	})
+}
+
+func (s *Store) DeleteDirectory(ctx context.Context, path string) error {
+	return run(ctx, s, OpDeleteDir, path, func(ctx context.Context) error {
+		return s.inner.DeleteDirectory(ctx, path)
+	})
+}
+
+func (s *Store) SafeDeleteDirectory(ctx context.Context, path string) error {
+	return run(ctx, s, OpDeleteDir, path, func(ctx context.Context) error {
+		return s.inner.SafeDeleteDirectory(ctx, path)
+	})
+}
+
+func (s *Store) GetDirectorySize(ctx context.Context, path string) (int64, error) {
+	return get(ctx, s, OpDirSize, path, func(ctx context.Context) (int64, error) {
+		return s.inner.GetDirectorySize(ctx, path)
+	})
+}
+
+func (s *Store) DeleteDirectoryParallel(ctx context.Context, path string) error {
+	return run(ctx, s, OpDeleteDir, path, func(ctx context.Context) error {
+		return s.inner.DeleteDirectoryParallel(ctx, path)
+	})
+}
+
+// reader keeps the context of the Open call alive until it is closed.
+type reader struct {
+	io.ReadSeekCloser
+	release context.CancelFunc
+}
+
+func (r *reader) Close() error {
+	defer r.release()
+	return r.ReadSeekCloser.Close()
+}
+
+// writer bounds Close, the call that waits for the backend to store the
+// object. A timed out Close cancels the upload.
+type writer struct {
+	ctx     context.Context
+	store   *Store
+	path    string
+	w       filestore.Writer
+	release context.CancelFunc
+	mu      sync.Mutex
+	closed  bool
+	err     error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	defer w.release()
+
+	w.err = run(w.ctx, w.store, OpClose, w.path, func(context.Context) error {
+		return w.w.Close()
+	})
+	return w.err
+}
+
+func (w *writer) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.release()
+
+	return w.w.Abort()
+}
@@ -0,0 +1,460 @@
+// Package storetest is a conformance suite for filestore.Store backends.
+//
+// Each backend runs the same suite from its own test, for example:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) filestore.Store {
+//			s, err := local.NewStore(t.TempDir())
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return s
+//		})
+//	}
+//
+// MinIO is exercised the same way against a throwaway bucket on a local
+// stand-in server (the docker-compose minio service is enough).
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strunetsdrive/pkg/filestore"
+	"testing"
+)
+
+// Run executes every conformance check. newStore is called once per subtest
+// and must return an empty store.
+func Run(t *testing.T, newStore func(t *testing.T) filestore.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s filestore.Store)
+	}{
+		{"CreateOpen", testCreateOpen},
+		{"Seek", testSeek},
+		{"OpenMissing", testOpenMissing},
+		{"Overwrite", testOverwrite},
+		{"Abort", testAbort},
+		{"CancelCreate", testCancelCreate},
+		{"CloseTwice", testCloseTwice},
+		{"ObjectInfo", testObjectInfo},
+		{"Delete", testDelete},
+		{"ListObjects", testListObjects},
+		{"MoveObject", testMoveObject},
+		{"CopyObject", testCopyObject},
+		{"DeleteDirectory", testDeleteDirectory},
+		{"SafeDeleteDirectory", testSafeDeleteDirectory},
+		{"DeleteDirectoryParallel", testDeleteDirectoryParallel},
+		{"GetDirectorySize", testGetDirectorySize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func testCreateOpen(t *testing.T, s filestore.Store) {
+	content := []byte("hello, storage")
+	writeObject(t, s, "user/folder/file", content)
+
+	if got := readObject(t, s, "user/folder/file"); !bytes.Equal(got, content) {
+		t.Fatalf("read %q, want %q", got, content)
+	}
+}
+
+func testSeek(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	writeObject(t, s, "user/seek", []byte("0123456789"))
+
+	r, err := s.Open(ctx, "user/seek")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer r.Close()
+
+	seeks := []struct {
+		offset int64
+		whence int
+		pos    int64
+		want   string
+	}{
+		{4, io.SeekStart, 4, "45"},
+		{2, io.SeekCurrent, 8, "89"},
+		{-3, io.SeekEnd, 7, "78"},
+		{0, io.SeekStart, 0, "01"},
+	}
+
+	for _, sk := range seeks {
+		pos, err := r.Seek(sk.offset, sk.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d): %v", sk.offset, sk.whence, err)
+		}
+		if pos != sk.pos {
+			t.Fatalf("Seek(%d, %d) = %d, want %d", sk.offset, sk.whence, pos, sk.pos)
+		}
+
+		buf := make([]byte, len(sk.want))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("read after Seek(%d, %d): %v", sk.offset, sk.whence, err)
+		}
+		if string(buf) != sk.want {
+			t.Fatalf("read after Seek(%d, %d) = %q, want %q", sk.offset, sk.whence, buf, sk.want)
+		}
+	}
+
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil || end != 10 {
+		t.Fatalf("Seek to end = %d, %v, want 10", end, err)
+	}
+}
+
+func testOpenMissing(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	if _, err := s.Open(ctx, "user/missing"); !errors.Is(err, filestore.ErrNotExist) {
+		t.Fatalf("Open missing object: got %v, want ErrNotExist", err)
+	}
+
+	if _, err := s.GetObjectInfo(ctx, "user/missing"); !errors.Is(err, filestore.ErrNotExist) {
+		t.Fatalf("GetObjectInfo missing object: got %v, want ErrNotExist", err)
+	}
+
+	exists, err := s.ObjectExists(ctx, "user/missing")
+	if err != nil || exists {
+		t.Fatalf("ObjectExists missing object = %v, %v", exists, err)
+	}
+}
+
+func testOverwrite(t *testing.T, s filestore.Store) {
+	writeObject(t, s, "user/file", []byte("first version"))
+	writeObject(t, s, "user/file", []byte("second"))
+
+	if got := readObject(t, s, "user/file"); string(got) != "second" {
+		t.Fatalf("read %q after overwrite, want %q", got, "second")
+	}
+}
+
+func testAbort(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	w, err := s.Create(ctx, "user/aborted")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	assertMissing(t, s, "user/aborted")
+
+	writeObject(t, s, "user/kept", []byte("original"))
+	w, err = s.Create(ctx, "user/kept")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("replacement")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	if got := readObject(t, s, "user/kept"); string(got) != "original" {
+		t.Fatalf("read %q after aborted overwrite, want %q", got, "original")
+	}
+}
+
+func testCancelCreate(t *testing.T, s filestore.Store) {
+	writeObject(t, s, "user/kept", []byte("original"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := s.Create(ctx, "user/kept")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("replacement")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	cancel()
+	if err := w.Close(); err == nil {
+		t.Fatal("Close after cancel succeeded")
+	}
+	if got := readObject(t, s, "user/kept"); string(got) != "original" {
+		t.Fatalf("read %q after cancelled overwrite, want %q", got, "original")
+	}
+}
+
+func testCloseTwice(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	w, err := s.Create(ctx, "user/closed")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("x")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("Abort after Close: %v", err)
+	}
+	if got := readObject(t, s, "user/closed"); string(got) != "x" {
+		t.Fatalf("read %q, want %q", got, "x")
+	}
+}
+
+func testObjectInfo(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	writeObject(t, s, "user/info", []byte("12345"))
+
+	info, err := s.GetObjectInfo(ctx, "user/info")
+	if err != nil {
+		t.Fatalf("GetObjectInfo: %v", err)
+	}
+	if info.Path != "user/info" || info.Size != 5 || info.IsDirectory {
+		t.Fatalf("GetObjectInfo = %+v", info)
+	}
+
+	exists, err := s.ObjectExists(ctx, "user/info")
+	if err != nil || !exists {
+		t.Fatalf("ObjectExists = %v, %v, want true", exists, err)
+	}
+}
+
+func testDelete(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	writeObject(t, s, "user/doomed", []byte("x"))
+
+	if err := s.Delete(ctx, "user/doomed"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	assertMissing(t, s, "user/doomed")
+
+	if err := s.Delete(ctx, "user/doomed"); err != nil {
+		t.Fatalf("Delete of missing object should succeed, got %v", err)
+	}
+}
+
+func testListObjects(t *testing.T, s filestore.Store) {
+	writeObject(t, s, "user/a/one", []byte("1"))
+	writeObject(t, s, "user/a/two", []byte("22"))
+	writeObject(t, s, "user/a/sub/three", []byte("333"))
+	writeObject(t, s, "user/ab/four", []byte("4444"))
+	writeObject(t, s, "other/five", []byte("55555"))
+
+	got := listPaths(t, s, "user/a/")
+	want := map[string]bool{"user/a/one": false, "user/a/two": false, "user/a/sub/": true}
+	assertListing(t, "user/a/", got, want)
+
+	got = listPaths(t, s, "user/a")
+	want = map[string]bool{"user/a/": true, "user/ab/": true}
+	assertListing(t, "user/a", got, want)
+
+	got = listPaths(t, s, "user/a/t")
+	want = map[string]bool{"user/a/two": false}
+	assertListing(t, "user/a/t", got, want)
+
+	if got := listPaths(t, s, "nobody/"); len(got) != 0 {
+		t.Fatalf("ListObjects(nobody/) = %v, want empty", got)
+	}
+}
+
+func testMoveObject(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	writeObject(t, s, "user/src/file", []byte("moving"))
+
+	if err := s.MoveObject(ctx, "user/src/file", "user/dst/file"); err != nil {
+		t.Fatalf("MoveObject: %v", err)
+	}
+
+	assertMissing(t, s, "user/src/file")
+	if got := readObject(t, s, "user/dst/file"); string(got) != "moving" {
+		t.Fatalf("read %q after move, want %q", got, "moving")
+	}
+
+	if err := s.MoveObject(ctx, "user/src/file", "user/dst/other"); err == nil {
+		t.Fatal("MoveObject of missing source should fail")
+	}
+}
+
+func testCopyObject(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	writeObject(t, s, "user/src/file", []byte("original"))
+	writeObject(t, s, "user/dst/file", []byte("replaced"))
+
+	if err := s.CopyObject(ctx, "user/src/file", "user/dst/file"); err != nil {
+		t.Fatalf("CopyObject: %v", err)
+	}
+
+	if got := readObject(t, s, "user/dst/file"); string(got) != "original" {
+		t.Fatalf("read %q from copy, want %q", got, "original")
+	}
+
+	// The copy must not follow later changes to its source.
+	writeObject(t, s, "user/src/file", []byte("changed"))
+	if got := readObject(t, s, "user/dst/file"); string(got) != "original" {
+		t.Fatalf("read %q from copy after overwriting source, want %q", got, "original")
+	}
+
+	if err := s.Delete(ctx, "user/src/file"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got := readObject(t, s, "user/dst/file"); string(got) != "original" {
+		t.Fatalf("read %q from copy after deleting source, want %q", got, "original")
+	}
+
+	if err := s.CopyObject(ctx, "user/src/file", "user/dst/other"); err == nil {
+		t.Fatal("CopyObject of missing source should fail")
+	}
+}
+
+func testDeleteDirectory(t *testing.T, s filestore.Store) {
+	testDirectoryDelete(t, s, s.DeleteDirectory)
+}
+
+func testDeleteDirectoryParallel(t *testing.T, s filestore.Store) {
+	testDirectoryDelete(t, s, s.DeleteDirectoryParallel)
+}
+
+func testDirectoryDelete(t *testing.T, s filestore.Store, deleteDir func(context.Context, string) error) {
+	writeObject(t, s, "user/dir/one", []byte("1"))
+	writeObject(t, s, "user/dir/nested/two", []byte("2"))
+	writeObject(t, s, "user/dirsibling/three", []byte("3"))
+
+	if err := deleteDir(context.Background(), "user/dir"); err != nil {
+		t.Fatalf("delete directory: %v", err)
+	}
+
+	assertMissing(t, s, "user/dir/one")
+	assertMissing(t, s, "user/dir/nested/two")
+	if got := readObject(t, s, "user/dirsibling/three"); string(got) != "3" {
+		t.Fatal("delete directory removed a sibling sharing its name prefix")
+	}
+}
+
+func testSafeDeleteDirectory(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	writeObject(t, s, "user/full/file", []byte("x"))
+
+	if err := s.SafeDeleteDirectory(ctx, "user/full"); !errors.Is(err, filestore.ErrNotEmpty) {
+		t.Fatalf("SafeDeleteDirectory of non-empty directory: got %v, want ErrNotEmpty", err)
+	}
+	if got := readObject(t, s, "user/full/file"); string(got) != "x" {
+		t.Fatal("SafeDeleteDirectory removed content of a non-empty directory")
+	}
+
+	if err := s.CreateDirectory(ctx, "user/empty"); err != nil {
+		t.Fatalf("CreateDirectory: %v", err)
+	}
+	if err := s.SafeDeleteDirectory(ctx, "user/empty"); err != nil {
+		t.Fatalf("SafeDeleteDirectory of empty directory: %v", err)
+	}
+	if got := listPaths(t, s, "user/"); got["user/empty/"] {
+		t.Fatal("empty directory still listed after SafeDeleteDirectory")
+	}
+}
+
+func testGetDirectorySize(t *testing.T, s filestore.Store) {
+	ctx := context.Background()
+	writeObject(t, s, "user/size/a", []byte("12345"))
+	writeObject(t, s, "user/size/nested/b", []byte("1234567"))
+	writeObject(t, s, "user/sizeother/c", []byte("123"))
+
+	size, err := s.GetDirectorySize(ctx, "user/size")
+	if err != nil {
+		t.Fatalf("GetDirectorySize: %v", err)
+	}
+	if size != 12 {
+		t.Fatalf("GetDirectorySize = %d, want 12", size)
+	}
+
+	size, err = s.GetDirectorySize(ctx, "user/nothing")
+	if err != nil || size != 0 {
+		t.Fatalf("GetDirectorySize of missing directory = %d, %v, want 0", size, err)
+	}
+}
+
+func writeObject(t *testing.T, s filestore.Store, path string, content []byte) {
+	ctx := context.Background()
+	t.Helper()
+
+	w, err := s.Create(ctx, path)
+	if err != nil {
+		t.Fatalf("Create(%s): %v", path, err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Write(%s): %v", path, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(%s): %v", path, err)
+	}
+}
+
+func readObject(t *testing.T, s filestore.Store, path string) []byte {
+	ctx := context.Background()
+	t.Helper()
+
+	r, err := s.Open(ctx, path)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", path, err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", path, err)
+	}
+	return data
+}
+
+func assertMissing(t *testing.T, s filestore.Store, path string) {
+	ctx := context.Background()
+	t.Helper()
+
+	exists, err := s.ObjectExists(ctx, path)
+	if err != nil {
+		t.Fatalf("ObjectExists(%s): %v", path, err)
+	}
+	if exists {
+		t.Fatalf("object %s still exists", path)
+	}
+}
+
+// listPaths returns the listed keys mapped to their IsDirectory flag.
+func listPaths(t *testing.T, s filestore.Store, prefix string) map[string]bool {
+	ctx := context.Background()
+	t.Helper()
+
+	objects, err := s.ListObjects(ctx, prefix)
+	if err != nil {
+		t.Fatalf("ListObjects(%s): %v", prefix, err)
+	}
+
+	paths := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		paths[obj.Path] = obj.IsDirectory
+	}
+	return paths
+}
+
+func assertListing(t *testing.T, prefix string, got, want map[string]bool) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("ListObjects(%s) = %v, want %v", prefix, got, want)
+	}
+	for path, isDir := range want {
+		gotDir, ok := got[path]
+		if !ok || gotDir != isDir {
+			t.Fatalf("ListObjects(%s) = %v, want %v", prefix, got, want)
+		}
+	}
+}
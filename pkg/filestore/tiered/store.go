@@ -0,0 +1,200 @@
+package tiered
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"strunetsdrive/pkg/filestore"
+	"time"
+)
+
+// ColdPrefix marks keys that live on the cold tier. The tier is part of the
+// key, so a stored path alone tells where an object is and everything that
+// only handles paths keeps working across tiers.
+const ColdPrefix = "cold/"
+
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
+// ColdPath returns the key path has on the cold tier.
+func ColdPath(path string) string {
+	return ColdPrefix + HotPath(path)
+}
+
+// HotPath returns the key path has on the hot tier.
+func HotPath(path string) string {
+	return strings.TrimPrefix(path, ColdPrefix)
+}
+
+// TierOf returns the tier a key belongs to.
+func TierOf(path string) string {
+	if strings.HasPrefix(path, ColdPrefix) {
+		return TierCold
+	}
+	return TierHot
+}
+
+// Store routes keys under ColdPrefix to a cold store, with the prefix
+// stripped, and every other key to a hot store. Moving a key across the
+// prefix copies the object between the two stores.
+type Store struct {
+	hot  filestore.Store
+	cold filestore.Store
+}
+
+func NewStore(hot, cold filestore.Store) *Store {
+	return &Store{hot: hot, cold: cold}
+}
+
+func (s *Store) route(path string) (filestore.Store, string) {
+	if TierOf(path) == TierCold {
+		return s.cold, HotPath(path)
+	}
+	return s.hot, path
+}
+
+func (s *Store) Create(ctx context.Context, path string) (filestore.Writer, error) {
+	store, key := s.route(path)
+	return store.Create(ctx, key)
+}
+
+func (s *Store) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	store, key := s.route(path)
+	return store.Open(ctx, key)
+}
+
+func (s *Store) GetPresignedURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	store, key := s.route(path)
+	return store.GetPresignedURL(ctx, key, expires)
+}
+
+func (s *Store) GetPresignedPutURL(ctx context.Context, path string, expires time.Duration) (string, error) {
+	store, key := s.route(path)
+	return store.GetPresignedPutURL(ctx, key, expires)
+}
+
+func (s *Store) Delete(ctx context.Context, path string) error {
+	store, key := s.route(path)
+	return store.Delete(ctx, key)
+}
+
+func (s *Store) CreateDirectory(ctx context.Context, path string) error {
+	store, key := s.route(path)
+	return store.CreateDirectory(ctx, key)
+}
+
+func (s *Store) MoveObject(ctx context.Context, sourcePath, destPath string) error {
+	if TierOf(sourcePath) == TierOf(destPath) {
+		store, src := s.route(sourcePath)
+		_, dst := s.route(destPath)
+		return store.MoveObject(ctx, src, dst)
+	}
+
+	if err := s.CopyObject(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	return s.Delete(ctx, sourcePath)
+}
+
+// CopyObject copies natively within a tier and streams the content between
+// tiers.
+func (s *Store) CopyObject(ctx context.Context, sourcePath, destPath string) error {
+	if TierOf(sourcePath) == TierOf(destPath) {
+		store, src := s.route(sourcePath)
+		_, dst := s.route(destPath)
+		return store.CopyObject(ctx, src, dst)
+	}
+
+	return filestore.StreamCopy(ctx, s, sourcePath, s, destPath)
+}
+
+// ListObjects lists the tier prefix belongs to. A listing of the hot tier
+// that could contain ColdPrefix shows it as a directory while the cold tier
+// holds anything.
+func (s *Store) ListObjects(ctx context.Context, prefix string) ([]filestore.ObjectInfo, error) {
+	if TierOf(prefix) == TierCold {
+		objects, err := s.cold.ListObjects(ctx, HotPath(prefix))
+		if err != nil {
+			return nil, err
+		}
+		for i := range objects {
+			objects[i].Path = ColdPrefix + objects[i].Path
+		}
+		return objects, nil
+	}
+
+	objects, err := s.hot.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(ColdPrefix, prefix) {
+		return objects, nil
+	}
+
+	coldObjects, err := s.cold.ListObjects(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(coldObjects) > 0 {
+		objects = append(objects, filestore.ObjectInfo{
+			Path:        ColdPrefix,
+			ContentType: "application/x-directory",
+			IsDirectory: true,
+		})
+		sort.Slice(objects, func(i, j int) bool {
+			return objects[i].Path < objects[j].Path
+		})
+	}
+
+	return objects, nil
+}
+
+func (s *Store) GetObjectInfo(ctx context.Context, path string) (*filestore.ObjectInfo, error) {
+	store, key := s.route(path)
+	info, err := store.GetObjectInfo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Path = path
+	return info, nil
+}
+
+func (s *Store) ObjectExists(ctx context.Context, path string) (bool, error) {
+	store, key := s.route(path)
+	return store.ObjectExists(ctx, key)
+}
+
+func (s *Store) DeleteDirectory(ctx context.Context, path string) error {
+	store, key := s.route(path)
+	return store.DeleteDirectory(ctx, key)
+}
+
+func (s *Store) SafeDeleteDirectory(ctx context.Context, path string) error {
+	store, key := s.route(path)
+	return store.SafeDeleteDirectory(ctx, key)
+}
+
+// GetDirectorySize of the root adds up both tiers.
+func (s *Store) GetDirectorySize(ctx context.Context, path string) (int64, error) {
+	store, key := s.route(path)
+	size, err := store.GetDirectorySize(ctx, key)
+	if err != nil || (path != "" && path != "/") {
+		return size, err
+	}
+
+	coldSize, err := s.cold.GetDirectorySize(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	return size + coldSize, nil
+}
+
+func (s *Store) DeleteDirectoryParallel(ctx context.Context, path string) error {
+	store, key := s.route(path)
+	return store.DeleteDirectoryParallel(ctx, key)
+}
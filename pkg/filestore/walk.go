@@ -0,0 +1,33 @@
+package filestore
+
+import (
+	"context"
+	"strings"
+)
+
+// Walk calls fn for every object under prefix, descending into directories.
+// Directory markers themselves are not reported.
+func Walk(ctx context.Context, store Store, prefix string, fn func(obj ObjectInfo) error) error {
+	objects, err := store.ListObjects(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objects {
+		if obj.IsDirectory || strings.HasSuffix(obj.Path, "/") {
+			if obj.Path == prefix {
+				continue
+			}
+			if err := Walk(ctx, store, obj.Path, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}